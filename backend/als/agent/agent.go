@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller/federation"
+	"github.com/X-Zero-L/als/als/ratelimit"
+	"github.com/X-Zero-L/als/config"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Run keeps a tunnel to the controller open, reconnecting with a growing
+// delay, and runs the jobs received through it on handler
+func Run(handler http.Handler) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := connect(handler)
+		log.Default().Printf("WARN: Agent tunnel to %s closed: %v", config.Get().AgentControllerURL, err)
+
+		// A tunnel that stayed up for a while is not a failing controller
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// tunnel is an open connection to the controller
+type tunnel struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	handler http.Handler
+
+	jobsMu sync.Mutex
+	jobs   map[string]context.CancelFunc
+}
+
+func (t *tunnel) send(msg federation.TunnelMessage) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	t.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return t.conn.WriteJSON(msg)
+}
+
+// connect registers with the controller and serves jobs until the tunnel breaks
+func connect(handler http.Handler) error {
+	cfg := config.Get()
+	endpoint := strings.TrimRight(cfg.AgentControllerURL, "/") + "/api/agent/connect"
+	endpoint = "ws" + strings.TrimPrefix(endpoint, "http")
+
+	header := http.Header{}
+	header.Set("X-Api-Key", cfg.AgentToken)
+	conn, resp, err := websocket.DefaultDialer.Dial(endpoint, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%w (HTTP %d)", err, resp.StatusCode)
+		}
+		return err
+	}
+	defer conn.Close()
+
+	t := &tunnel{
+		conn:    conn,
+		handler: handler,
+		jobs:    make(map[string]context.CancelFunc),
+	}
+	defer func() {
+		t.jobsMu.Lock()
+		for _, cancel := range t.jobs {
+			cancel()
+		}
+		t.jobsMu.Unlock()
+	}()
+
+	metadata := cfg.AdvertisedMetadata()
+	err = t.send(federation.TunnelMessage{
+		Type:     "register",
+		Name:     nodeName(cfg),
+		Location: nodeLocation(cfg),
+		Metadata: &metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	var reply federation.TunnelMessage
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if err := conn.ReadJSON(&reply); err != nil {
+		return err
+	}
+	if reply.Type != "registered" {
+		return fmt.Errorf("registration rejected: %s", reply.Error)
+	}
+	log.Default().Printf("Agent registered with %s as node %s", cfg.AgentControllerURL, reply.NodeID)
+
+	// The controller pings regularly, a silent tunnel is a dead one
+	conn.SetReadDeadline(time.Now().Add(federation.TunnelReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(federation.TunnelReadTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+	})
+
+	for {
+		var msg federation.TunnelMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(federation.TunnelReadTimeout))
+
+		switch msg.Type {
+		case "job":
+			ctx, cancel := context.WithCancel(context.Background())
+			t.jobsMu.Lock()
+			t.jobs[msg.Job] = cancel
+			t.jobsMu.Unlock()
+			go t.runJob(ctx, msg)
+		case "cancel":
+			t.jobsMu.Lock()
+			if cancel, ok := t.jobs[msg.Job]; ok {
+				cancel()
+			}
+			t.jobsMu.Unlock()
+		}
+	}
+}
+
+// runJob runs a method through the local routes, as if a browser session had
+// requested it, and streams its events back
+func (t *tunnel) runJob(ctx context.Context, job federation.TunnelMessage) {
+	defer func() {
+		t.jobsMu.Lock()
+		if cancel, ok := t.jobs[job.Job]; ok {
+			cancel()
+			delete(t.jobs, job.Job)
+		}
+		t.jobsMu.Unlock()
+	}()
+
+	if _, ok := federation.EventNames[job.Method]; !ok {
+		t.send(federation.TunnelMessage{Type: "done", Job: job.Job, Status: 400, Body: `{"success":false,"error":"Method not supported"}`})
+		return
+	}
+
+	sessionID := uuid.New().String()
+	clientSession := &client.ClientSession{Channel: make(chan *client.Message), ClientIP: "127.0.0.1"}
+	clientSession.SetContext(ctx)
+	client.AddClient(sessionID, clientSession)
+	defer client.RemoveClient(sessionID)
+
+	// Forward the events of the method, broadcasts to every session are dropped
+	stop := make(chan struct{})
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case msg := <-clientSession.Channel:
+				if federation.Relayed(job.Method, msg.Name) {
+					t.send(federation.TunnelMessage{Type: "event", Job: job.Job, Name: msg.Name, Data: msg.Content})
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// The controller applied its rate limits to the client already
+	req := httptest.NewRequest("GET", "/method/"+job.Method+"?"+job.Query, nil).WithContext(ratelimit.WithoutLimits(ctx))
+	req.Header.Set("session", sessionID)
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, req)
+
+	// Every event was handed over before the handler returned, wait for the
+	// last one to be sent so done comes after it
+	close(stop)
+	<-forwarded
+
+	t.send(federation.TunnelMessage{Type: "done", Job: job.Job, Status: recorder.Code, Body: recorder.Body.String()})
+}
+
+// nodeName is the name the agent registers with
+func nodeName(cfg *config.ALSConfig) string {
+	if cfg.CurrentNodeName != "" {
+		return cfg.CurrentNodeName
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func nodeLocation(cfg *config.ALSConfig) string {
+	if cfg.CurrentNodeLocation != "" {
+		return cfg.CurrentNodeLocation
+	}
+	return cfg.Location
+}
@@ -3,7 +3,10 @@ package als
 import (
 	"log"
 
-	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/agent"
+	"github.com/X-Zero-L/als/als/controller/nodes"
+	"github.com/X-Zero-L/als/als/enroll"
+	"github.com/X-Zero-L/als/als/ratelimit"
 	"github.com/X-Zero-L/als/als/timer"
 	"github.com/X-Zero-L/als/config"
 	alsHttp "github.com/X-Zero-L/als/http"
@@ -12,15 +15,23 @@ import (
 func Init() {
 	aHttp := alsHttp.CreateServer()
 
-	log.Default().Println("Listen on: " + config.Config.ListenHost + ":" + config.Config.ListenPort)
-	aHttp.SetListen(config.Config.ListenHost + ":" + config.Config.ListenPort)
+	log.Default().Println("Listen on: " + config.Get().ListenHost + ":" + config.Get().ListenPort)
+	aHttp.SetListen(config.Get().ListenHost + ":" + config.Get().ListenPort)
 
+	nodes.Init()
 	SetupHttpRoute(aHttp.GetEngine())
 
-	if config.Config.FeatureIfaceTraffic {
-		go timer.SetupInterfaceBroadcast()
-	}
+	go timer.SetupInterfaceBroadcast()
 	go timer.UpdateSystemResource()
-	go client.HandleQueue()
+	go nodes.RunHealthCheck()
+	go nodes.RunEnrollmentExpiry()
+	go ratelimit.RunCleanup()
+	go watchReloadSignal()
+	if config.Get().AgentControllerURL != "" {
+		go agent.Run(aHttp.GetEngine())
+	}
+	if config.Get().ControllerURL != "" {
+		go enroll.Run()
+	}
 	aHttp.Start()
 }
@@ -0,0 +1,49 @@
+package als
+
+import (
+	"github.com/X-Zero-L/als/als/controller"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// methods tells whether each tool can be used with the given config. It backs
+// both the route gating and the /capabilities endpoint so they never disagree.
+var methods = map[string]func(cfg *config.ALSConfig) bool{
+	"ping":              func(cfg *config.ALSConfig) bool { return cfg.FeaturePing },
+	"ping6":             func(cfg *config.ALSConfig) bool { return cfg.FeaturePing },
+	"tcping":            func(cfg *config.ALSConfig) bool { return cfg.FeaturePing },
+	"udping":            func(cfg *config.ALSConfig) bool { return cfg.FeaturePing },
+	"httping":           func(cfg *config.ALSConfig) bool { return cfg.FeaturePing },
+	"mtr":               func(cfg *config.ALSConfig) bool { return cfg.FeatureMTR },
+	"mtr6":              func(cfg *config.ALSConfig) bool { return cfg.FeatureMTR },
+	"traceroute":        func(cfg *config.ALSConfig) bool { return cfg.FeatureTraceroute && cfg.HasCapability("traceroute") },
+	"traceroute6":       func(cfg *config.ALSConfig) bool { return cfg.FeatureTraceroute && cfg.HasCapability("traceroute6") },
+	"speedtest_dot_net": func(cfg *config.ALSConfig) bool { return cfg.FeatureSpeedtestDotNet },
+	"iperf3":            func(cfg *config.ALSConfig) bool { return cfg.FeatureIperf3 },
+	"librespeed":        func(cfg *config.ALSConfig) bool { return cfg.FeatureLibrespeed },
+	"file_speedtest":    func(cfg *config.ALSConfig) bool { return cfg.FeatureFileSpeedtest },
+	"shell":             func(cfg *config.ALSConfig) bool { return cfg.FeatureShell },
+	"iface_traffic":     func(cfg *config.ALSConfig) bool { return cfg.FeatureIfaceTraffic },
+}
+
+// featureGate returns the middleware rejecting requests to a disabled method
+func featureGate(method string) gin.HandlerFunc {
+	return controller.MiddlewareFeature(methods[method])
+}
+
+// handleCapabilities lists the methods usable on this node and the external
+// binaries found, so dashboards can build per-node menus
+func handleCapabilities(c *gin.Context) {
+	cfg := config.Get()
+
+	enabled := make(map[string]bool, len(methods))
+	for name, available := range methods {
+		enabled[name] = available(cfg)
+	}
+
+	c.JSON(200, &gin.H{
+		"success":  true,
+		"methods":  enabled,
+		"binaries": cfg.Capabilities,
+	})
+}
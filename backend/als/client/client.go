@@ -16,8 +16,9 @@ type Message struct {
 }
 
 type ClientSession struct {
-	Channel chan *Message
-	ctx     context.Context
+	Channel  chan *Message
+	ClientIP string
+	ctx      context.Context
 }
 
 func (c *ClientSession) SetContext(ctx context.Context) {
@@ -41,6 +42,17 @@ func (c *ClientSession) GetContext(requestCtx context.Context) context.Context {
 	return ctx
 }
 
+// Send delivers msg to the session, it gives up and reports false once the
+// session is closed
+func (c *ClientSession) Send(msg *Message) bool {
+	select {
+	case c.Channel <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
 // AddClient safely adds a client to the map
 func AddClient(id string, client *ClientSession) {
 	ClientsMu.Lock()
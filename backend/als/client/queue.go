@@ -2,73 +2,335 @@ package client
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/config"
+)
+
+// Resource pools, each one has its own queue and concurrency limit
+const (
+	PoolSpeedtestCLI = "speedtest_cli"
+	PoolFileDownload = "file_download"
+	PoolIperf3       = "iperf3"
+	PoolMTR          = "mtr"
+	PoolTraceroute   = "traceroute"
+)
+
+// Causes of a job context ending before its handler finished, see
+// context.Cause
+var (
+	ErrJobCancelled = errors.New("job was cancelled by an administrator")
+	ErrJobTimeout   = errors.New("job exceeded the maximum run time")
 )
 
-var queueLine = make(map[context.Context]context.CancelFunc, 0)
+// Job describes a run in a queue pool
+type Job struct {
+	Pool      string
+	Tool      string
+	SessionID string
+	ClientIP  string
+	Target    string
+}
+
+// JobStatus is a queued or running job as listed to admins
+type JobStatus struct {
+	ID        string     `json:"id"`
+	Pool      string     `json:"pool"`
+	Tool      string     `json:"tool"`
+	SessionID string     `json:"session_id"`
+	ClientIP  string     `json:"client_ip"`
+	Target    string     `json:"target"`
+	State     string     `json:"state"` // queued or running
+	Position  int        `json:"position,omitempty"`
+	QueuedAt  time.Time  `json:"queued_at"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+}
+
+// queueEntry is a caller in the wait queue of a pool
+type queueEntry struct {
+	id       string
+	seq      int // order of arrival across pools
+	job      Job
+	parent   context.Context
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	serve    chan struct{} // closed when it is the caller's turn
+	served   bool
+	queuedAt time.Time
+	started  time.Time
+	notify   func(position int, total int)
+
+	// last position reported to notify and the number of updates made,
+	// guarded by queueLock
+	position int
+	total    int
+	updates  int
+
+	// notifyMu keeps the updates of the entry in order, notified is the
+	// last one delivered
+	notifyMu sync.Mutex
+	notified int
+}
+
+// queuePool holds the callers of a pool in order of arrival, the served ones
+// stay in the line until their context is done
+type queuePool struct {
+	line    []*queueEntry
+	running int
+}
+
+// waiting returns the callers of p not served yet, the caller must hold
+// queueLock
+func (p *queuePool) waiting() []*queueEntry {
+	var waiting []*queueEntry
+	for _, entry := range p.line {
+		if !entry.served {
+			waiting = append(waiting, entry)
+		}
+	}
+	return waiting
+}
+
+var queuePools = make(map[string]*queuePool)
 var queueLock = sync.Mutex{}
-var queueNotify = make(map[context.Context]func(), 0)
-var queueWakeup = make(chan struct{})
+var lastJobID = 0
+
+// poolLimit returns how many callers of pool may be served at the same time,
+// 0 is unlimited. Unknown pools are served one at a time.
+func poolLimit(pool string) int {
+	limit, ok := config.Get().Queue.Limits()[pool]
+	if !ok {
+		return 1
+	}
+	return limit
+}
+
+// WaitQueue blocks until it is the turn of job in its pool, or until ctx is
+// done. It returns the context the job must run under: it is cancelled when
+// ctx is done, when an admin cancels the job or when the maximum run time is
+// exceeded. The turn lasts until that context is done, calling the returned
+// function ends it early. cb is called with the position among the waiting
+// callers and their number whenever they change, starting with the initial
+// ones. It is called from another goroutine and must return once ctx is done.
+func WaitQueue(ctx context.Context, job Job, cb func(position int, total int)) (context.Context, context.CancelFunc) {
+	runCtx, cancel := context.WithCancelCause(ctx)
+	entry := &queueEntry{
+		job:      job,
+		parent:   ctx,
+		ctx:      runCtx,
+		cancel:   cancel,
+		serve:    make(chan struct{}),
+		queuedAt: time.Now().UTC().Truncate(time.Second),
+		notify:   cb,
+	}
 
-func WaitQueue(ctx context.Context, cb func()) {
-	queueCtx, cancel := context.WithCancel(ctx)
-	
 	queueLock.Lock()
-	queueLine[ctx] = cancel
-	if cb != nil {
-		queueNotify[ctx] = cb
+	lastJobID++
+	entry.seq = lastJobID
+	entry.id = fmt.Sprintf("job_%d", lastJobID)
+	p, ok := queuePools[job.Pool]
+	if !ok {
+		p = &queuePool{}
+		queuePools[job.Pool] = p
 	}
+	p.line = append(p.line, entry)
+	dispatch(job.Pool, p)
 	queueLock.Unlock()
+	notifyQueue()
 
 	select {
-	case queueWakeup <- struct{}{}:
-	default:
+	case <-entry.serve:
+	case <-runCtx.Done():
+		// Gave up waiting, once served the entry is removed by release
+		queueLock.Lock()
+		if !entry.served {
+			p.remove(entry)
+		}
+		queueLock.Unlock()
+		notifyQueue()
 	}
+	return runCtx, func() { cancel(context.Canceled) }
+}
 
-	select {
-	case <-queueCtx.Done():
-	case <-ctx.Done():
+// GetQueuePosition returns the 1-based position of ctx among the callers
+// waiting in the queue of pool and their number, or 0, 0 if ctx is not waiting
+func GetQueuePosition(pool string, ctx context.Context) (int, int) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	p, ok := queuePools[pool]
+	if !ok {
+		return 0, 0
+	}
+	waiting := p.waiting()
+	for i, entry := range waiting {
+		if entry.parent == ctx {
+			return i + 1, len(waiting)
+		}
 	}
+	return 0, 0
 }
 
-func GetQueuePostitionByCtx(ctx context.Context) (int, int) {
-	total := len(queueLine)
+// Jobs lists the queued and running jobs of every pool
+func Jobs() []JobStatus {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	var entries []*queueEntry
+	for _, p := range queuePools {
+		entries = append(entries, p.line...)
+	}
+	// Times are only kept to the second, the sequence tells the order
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	// Positions among the waiting callers of each pool
+	positions := make(map[string]int)
+	jobs := []JobStatus{}
+	for _, entry := range entries {
+		status := JobStatus{
+			ID:        entry.id,
+			Pool:      entry.job.Pool,
+			Tool:      entry.job.Tool,
+			SessionID: entry.job.SessionID,
+			ClientIP:  entry.job.ClientIP,
+			Target:    entry.job.Target,
+			State:     "queued",
+			QueuedAt:  entry.queuedAt,
+		}
+		if entry.served {
+			started := entry.started
+			status.State = "running"
+			status.StartedAt = &started
+		} else {
+			positions[entry.job.Pool]++
+			status.Position = positions[entry.job.Pool]
+		}
+		jobs = append(jobs, status)
+	}
+	return jobs
+}
 
-	found := false
-	count := 0
+// CancelJob ends a queued or running job, it reports false if there is no
+// such job
+func CancelJob(id string) bool {
 	queueLock.Lock()
-	for v, _ := range queueLine {
-		count++
-		if v == ctx {
-			found = true
-			break
+	defer queueLock.Unlock()
+
+	for _, p := range queuePools {
+		for _, entry := range p.line {
+			if entry.id == id {
+				entry.cancel(ErrJobCancelled)
+				return true
+			}
 		}
 	}
-	queueLock.Unlock()
+	return false
+}
 
-	if !found {
-		return 0, 0
+// dispatch serves the waiting callers of p in order of arrival while the pool
+// has free slots, the caller must hold queueLock
+func dispatch(pool string, p *queuePool) {
+	limit := poolLimit(pool)
+	for _, entry := range p.line {
+		if limit > 0 && p.running >= limit {
+			return
+		}
+		if entry.served || entry.ctx.Err() != nil {
+			continue
+		}
+		entry.served = true
+		entry.started = time.Now().UTC().Truncate(time.Second)
+		p.running++
+		close(entry.serve)
+		go release(pool, p, entry)
 	}
+}
+
+// release frees the slot of entry once its context is done, or cancels it
+// when it runs longer than queue.max_run_time
+func release(pool string, p *queuePool, entry *queueEntry) {
+	var limit <-chan time.Time
+	if maxRunTime := config.Get().Queue.MaxRunTime; maxRunTime > 0 {
+		timer := time.NewTimer(time.Duration(maxRunTime) * time.Second)
+		defer timer.Stop()
+		limit = timer.C
+	}
+
+	select {
+	case <-entry.ctx.Done():
+	case <-limit:
+		entry.cancel(ErrJobTimeout)
+	}
+
+	queueLock.Lock()
+	p.remove(entry)
+	p.running--
+	dispatch(pool, p)
+	queueLock.Unlock()
+	notifyQueue()
+}
 
-	return count, total
+// remove drops entry from the line, the caller must hold queueLock
+func (p *queuePool) remove(entry *queueEntry) {
+	for i, e := range p.line {
+		if e == entry {
+			p.line = append(p.line[:i], p.line[i+1:]...)
+			return
+		}
+	}
 }
 
-func HandleQueue() {
-	for {
-		<-queueWakeup
-		queueLock.Lock()
-		for ctx, notify := range queueLine {
-			queueLock.Unlock()
-			notify()
-			<-ctx.Done()
-			queueLock.Lock()
-			delete(queueLine, ctx)
-			delete(queueNotify, ctx)
-
-			for _, callNotify := range queueNotify {
-				callNotify()
+// notifyQueue tells the waiting callers whose position changed. Each update
+// is delivered from its own goroutine without any lock held, so a slow
+// callback only delays the updates of its own caller.
+func notifyQueue() {
+	var updates []queueUpdate
+	queueLock.Lock()
+	for _, p := range queuePools {
+		waiting := p.waiting()
+		for i, entry := range waiting {
+			position, total := i+1, len(waiting)
+			if entry.notify == nil || (entry.position == position && entry.total == total) {
+				continue
 			}
+			entry.position, entry.total = position, total
+			entry.updates++
+			updates = append(updates, queueUpdate{entry, entry.updates, position, total})
 		}
-		queueLock.Unlock()
 	}
+	queueLock.Unlock()
+
+	for _, u := range updates {
+		go u.deliver()
+	}
+}
+
+// queueUpdate is a position change of a waiting caller
+type queueUpdate struct {
+	entry           *queueEntry
+	seq             int
+	position, total int
+}
+
+// deliver calls the callback of the entry, unless a later update was already
+// delivered or the entry has been served since
+func (u queueUpdate) deliver() {
+	u.entry.notifyMu.Lock()
+	defer u.entry.notifyMu.Unlock()
+	if u.seq <= u.entry.notified {
+		return
+	}
+	u.entry.notified = u.seq
+
+	queueLock.Lock()
+	served := u.entry.served
+	queueLock.Unlock()
+	if served {
+		return
+	}
+	u.entry.notify(u.position, u.total)
 }
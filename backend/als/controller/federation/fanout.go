@@ -0,0 +1,184 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller/nodes"
+	"github.com/X-Zero-L/als/als/controller/ping"
+	"github.com/X-Zero-L/als/als/ratelimit"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// fanoutMethods are the methods that can be run on several nodes at once
+var fanoutMethods = []string{"ping", "ping6", "traceroute", "traceroute6"}
+
+// fanoutParams are the query parameters passed on to every node
+var fanoutParams = []string{"ip", "family", "count", "interval", "packet_size", "max_hops"}
+
+// maxFanout limits how many nodes are measured at the same time
+const maxFanout = 10
+
+// FanoutResult is the outcome of a method on one node
+type FanoutResult struct {
+	NodeID   string            `json:"node_id"`
+	Name     string            `json:"name"`
+	Location string            `json:"location"`
+	Success  bool              `json:"success"`
+	Error    string            `json:"error,omitempty"`
+	Ping     *ping.PingSummary `json:"ping,omitempty"` // as computed by the node
+}
+
+// HandleFanout runs a method against one target from every registered node
+// matching the GET /nodes filters. Node events are relayed tagged with the
+// node ID, followed by a FanoutResult event per node and a FanoutSummary
+// event with the comparison table.
+func HandleFanout(c *gin.Context) {
+	if !config.Get().FeatureFederation {
+		c.JSON(404, &gin.H{
+			"success": false,
+			"error":   "Feature disabled",
+		})
+		return
+	}
+
+	method := c.Param("method")
+	if !contains(fanoutMethods, method) {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   "Method not supported",
+		})
+		return
+	}
+
+	if c.Query("ip") == "" {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   "Invalid IP Address",
+		})
+		return
+	}
+
+	selected, err := nodes.Select(c)
+	if err != nil {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if len(selected) == 0 {
+		c.JSON(404, &gin.H{
+			"success": false,
+			"error":   "No nodes matched",
+		})
+		return
+	}
+
+	// Every node counts as a run of method for the limits of the client
+	parallel, done := ratelimit.Fanout(c, method, len(selected), min(len(selected), maxFanout))
+	if parallel == 0 {
+		return
+	}
+	defer done()
+
+	query := url.Values{}
+	for _, name := range fanoutParams {
+		if v, ok := c.GetQuery(name); ok {
+			query.Set(name, v)
+		}
+	}
+
+	v, _ := c.Get("clientSession")
+	clientSession := v.(*client.ClientSession)
+	ctx, cancel := context.WithCancel(clientSession.GetContext(c.Request.Context()))
+	defer cancel()
+
+	send := func(name string, content interface{}) {
+		data, _ := json.Marshal(content)
+		select {
+		case clientSession.Channel <- &client.Message{Name: name, Content: string(data)}:
+		case <-ctx.Done():
+		}
+	}
+
+	results := make([]FanoutResult, len(selected))
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, parallel)
+	for i := range selected {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			results[i] = fanoutNode(ctx, &selected[i], method, query, clientSession)
+			send("FanoutResult", results[i])
+		}(i)
+	}
+	wg.Wait()
+
+	summary := gin.H{
+		"method":  method,
+		"target":  c.Query("ip"),
+		"results": results,
+	}
+	send("FanoutSummary", summary)
+
+	c.JSON(200, &gin.H{
+		"success": true,
+		"results": results,
+	})
+}
+
+// fanoutNode runs method on node, relaying its events to clientSession
+func fanoutNode(ctx context.Context, node *nodes.Node, method string, query url.Values, clientSession *client.ClientSession) FanoutResult {
+	result := FanoutResult{
+		NodeID:   node.ID,
+		Name:     node.Name,
+		Location: node.Location,
+	}
+	if node.ApiKey == "" && !node.IsAgent() {
+		result.Error = "Node has no API key for federation"
+		return result
+	}
+
+	res := run(ctx, node, method, query, relayTo(ctx, clientSession, node.ID))
+
+	switch {
+	case res.err != nil:
+		result.Error = res.err.Error()
+	case res.status != 200:
+		result.Error = fmt.Sprintf("HTTP %d", res.status)
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(res.body, &body) == nil && body.Error != "" {
+			result.Error = body.Error
+		}
+	default:
+		result.Success = true
+		// Ping methods answer with the PingSummary they also sent as event
+		var body struct {
+			Summary *ping.PingSummary `json:"summary"`
+		}
+		if json.Unmarshal(res.body, &body) == nil {
+			result.Ping = body.Summary
+		}
+	}
+	return result
+}
+
+func contains(slice []string, item string) bool {
+	for _, a := range slice {
+		if a == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+package federation
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller/nodes"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// EventNames are the SSE events of each method that are relayed back
+var EventNames = map[string]string{
+	"ping":        "Ping",
+	"ping6":       "Ping6",
+	"tcping":      "TCPing",
+	"udping":      "UDPing",
+	"httping":     "HTTPing",
+	"mtr":         "MTROutput",
+	"mtr6":        "MTR6Output",
+	"traceroute":  "TracerouteOutput",
+	"traceroute6": "Traceroute6Output",
+}
+
+// Relayed reports whether the event name of method is relayed back, which
+// includes the Resolved event sent before the method starts and the
+// PingSummary event sent after it
+func Relayed(method string, name string) bool {
+	return name == EventNames[method] || name == "Resolved" || name == "PingSummary"
+}
+
+// drainTimeout is how long events are still relayed after the peer answered,
+// since they travel on a different connection than the answer
+const drainTimeout = 2 * time.Second
+
+type event struct {
+	name string
+	data string
+}
+
+type result struct {
+	status int
+	body   []byte
+	err    error
+}
+
+// Proxy runs method on the registered node given by the node query parameter
+// instead of locally, relaying its events to the session tagged with the node
+// ID. Requests without a node parameter are passed on to the local handler.
+func Proxy(method string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nodeID := c.Query("node")
+		if nodeID == "" {
+			c.Next()
+			return
+		}
+		c.Abort()
+
+		if !config.Get().FeatureFederation {
+			c.JSON(404, &gin.H{
+				"success": false,
+				"error":   "Feature disabled",
+			})
+			return
+		}
+
+		node, err := nodes.Lookup(nodeID)
+		if err != nil {
+			c.JSON(404, &gin.H{
+				"success": false,
+				"error":   "Node not found",
+			})
+			return
+		}
+		if !node.Active() {
+			message := fmt.Sprintf("Node is unavailable (%s)", node.State)
+			if node.StateMessage != "" {
+				message += ": " + node.StateMessage
+			}
+			c.JSON(503, &gin.H{
+				"success": false,
+				"error":   message,
+			})
+			return
+		}
+		if node.ApiKey == "" && !node.IsAgent() {
+			c.JSON(400, &gin.H{
+				"success": false,
+				"error":   "Node has no API key for federation",
+			})
+			return
+		}
+
+		v, _ := c.Get("clientSession")
+		clientSession := v.(*client.ClientSession)
+		ctx, cancel := context.WithCancel(clientSession.GetContext(c.Request.Context()))
+		defer cancel()
+
+		query := c.Request.URL.Query()
+		query.Del("node")
+
+		res := run(ctx, node, method, query, relayTo(ctx, clientSession, node.ID))
+		if res.err != nil {
+			c.JSON(502, &gin.H{
+				"success": false,
+				"error":   fmt.Sprintf("node %s: %v", node.Name, res.err),
+			})
+			return
+		}
+		c.Data(res.status, "application/json; charset=utf-8", res.body)
+	}
+}
+
+// run opens a session on the peer, starts method in it and passes the events
+// of method to relay until the peer answered. Agent nodes are reached through
+// their tunnel instead.
+func run(ctx context.Context, node *nodes.Node, method string, query url.Values, relay func(event)) result {
+	if node.IsAgent() {
+		return runAgent(ctx, node, method, query, relay)
+	}
+
+	base := strings.TrimRight(node.URL, "/") + "/api/federation"
+
+	resp, err := get(ctx, base+"/session", node.ApiKey, "")
+	if err != nil {
+		return result{err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return result{err: peerError(resp)}
+	}
+
+	events := make(chan event)
+	go readEvents(ctx, resp.Body, events)
+
+	// The first event carries the session ID
+	var sessionID string
+	select {
+	case e, ok := <-events:
+		if !ok || e.name != "SessionId" {
+			return result{err: fmt.Errorf("unexpected session stream")}
+		}
+		sessionID = e.data
+	case <-time.After(10 * time.Second):
+		return result{err: fmt.Errorf("timed out waiting for session")}
+	case <-ctx.Done():
+		return result{err: ctx.Err()}
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		resp, err := get(ctx, base+"/method/"+method+"?"+query.Encode(), node.ApiKey, sessionID)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		done <- result{status: resp.StatusCode, body: body, err: err}
+	}()
+
+	var res result
+	for waiting := true; waiting; {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+			} else if Relayed(method, e.name) {
+				relay(e)
+			}
+		case res = <-done:
+			waiting = false
+		case <-ctx.Done():
+			return result{err: ctx.Err()}
+		}
+	}
+
+	deadline := time.After(drainTimeout)
+	for events != nil {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+			} else if Relayed(method, e.name) {
+				relay(e)
+			}
+		case <-deadline:
+			events = nil
+		case <-ctx.Done():
+			events = nil
+		}
+	}
+
+	return res
+}
+
+// relayTo returns a relay passing events to clientSession tagged with nodeID
+func relayTo(ctx context.Context, clientSession *client.ClientSession, nodeID string) func(event) {
+	return func(e event) {
+		select {
+		case clientSession.Channel <- &client.Message{
+			Name:    e.name,
+			Content: tagNode(e.data, nodeID),
+		}:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// get sends an authenticated request to a peer
+func get(ctx context.Context, target string, apiKey string, sessionID string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Api-Key", apiKey)
+	if sessionID != "" {
+		req.Header.Set("session", sessionID)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// peerError turns an error answer of a peer into an error
+func peerError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		return fmt.Errorf("%s (HTTP %d)", body.Error, resp.StatusCode)
+	}
+	return fmt.Errorf("HTTP %d", resp.StatusCode)
+}
+
+// readEvents parses a server-sent event stream until it ends
+func readEvents(ctx context.Context, r io.Reader, events chan<- event) {
+	defer close(events)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	var e event
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if e.name != "" || len(data) > 0 {
+				e.data = strings.Join(data, "\n")
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			e, data = event{}, nil
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			e.name = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+// tagNode adds the node ID to a JSON object event, other events are left as is
+func tagNode(data string, nodeID string) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &fields); err != nil || fields == nil {
+		return data
+	}
+	fields["node_id"], _ = json.Marshal(nodeID)
+	tagged, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return string(tagged)
+}
@@ -0,0 +1,280 @@
+package federation
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/als/controller/nodes"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// TunnelMessage is exchanged as JSON over the agent WebSocket. An agent sends
+// register once, then event and done messages for the jobs it receives.
+type TunnelMessage struct {
+	Type     string               `json:"type"` // register, registered, job, cancel, event, done, error
+	Job      string               `json:"job,omitempty"`
+	Name     string               `json:"name,omitempty"` // node name on register, event name on event
+	Location string               `json:"location,omitempty"`
+	Metadata *config.NodeMetadata `json:"metadata,omitempty"`
+	NodeID   string               `json:"node_id,omitempty"`
+	Method   string               `json:"method,omitempty"`
+	Query    string               `json:"query,omitempty"`
+	Data     string               `json:"data,omitempty"`
+	Status   int                  `json:"status,omitempty"`
+	Body     string               `json:"body,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+const (
+	// TunnelPingInterval is how often the controller pings agents
+	TunnelPingInterval = 30 * time.Second
+	// TunnelReadTimeout drops a tunnel that stayed silent for this long
+	TunnelReadTimeout = 3 * TunnelPingInterval
+)
+
+var tunnelUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// agentConn is the tunnel of a connected agent
+type agentConn struct {
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+	jobsMu   sync.Mutex
+	jobs     map[string]*agentJob
+	lastSeen time.Time
+}
+
+// agentJob receives the messages of a job until the job is done or the
+// caller gave up, whichever comes first
+type agentJob struct {
+	messages chan TunnelMessage
+	done     chan struct{}
+}
+
+var (
+	agents   = make(map[string]*agentConn) // by node URL
+	agentsMu sync.RWMutex
+)
+
+func init() {
+	nodes.AgentHealth = agentHealth
+}
+
+func (a *agentConn) send(msg TunnelMessage) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	a.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return a.conn.WriteJSON(msg)
+}
+
+// seen records that the agent is alive
+func (a *agentConn) seen() {
+	a.jobsMu.Lock()
+	a.lastSeen = time.Now()
+	a.jobsMu.Unlock()
+	a.conn.SetReadDeadline(time.Now().Add(TunnelReadTimeout))
+}
+
+// HandleAgentConnect accepts the WebSocket of an agent, registers its node and
+// keeps the tunnel open for jobs
+func HandleAgentConnect(c *gin.Context) {
+	if !config.Get().FeatureFederation {
+		c.JSON(404, &gin.H{
+			"success": false,
+			"error":   "Feature disabled",
+		})
+		return
+	}
+
+	conn, err := tunnelUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	a := &agentConn{
+		conn:     conn,
+		jobs:     make(map[string]*agentJob),
+		lastSeen: time.Now(),
+	}
+
+	var register TunnelMessage
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.ReadJSON(&register); err != nil || register.Type != "register" || register.Name == "" {
+		a.send(TunnelMessage{Type: "error", Error: "expected a register message with a name"})
+		return
+	}
+
+	metadata := config.NodeMetadata{}
+	if register.Metadata != nil {
+		metadata = *register.Metadata
+	}
+	node, err := nodes.RegisterAgent(nodes.TokenID(c), register.Name, register.Location, metadata)
+	if err != nil {
+		a.send(TunnelMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	if err := a.send(TunnelMessage{Type: "registered", NodeID: node.ID}); err != nil {
+		return
+	}
+	log.Default().Printf("Agent %s connected from %s", node.Name, c.ClientIP())
+
+	agentsMu.Lock()
+	if old, ok := agents[node.URL]; ok {
+		// The agent reconnected before the old tunnel timed out
+		old.conn.Close()
+	}
+	agents[node.URL] = a
+	agentsMu.Unlock()
+
+	defer func() {
+		agentsMu.Lock()
+		if agents[node.URL] == a {
+			delete(agents, node.URL)
+		}
+		agentsMu.Unlock()
+
+		// Fail the jobs still running
+		a.jobsMu.Lock()
+		for id, job := range a.jobs {
+			close(job.messages)
+			delete(a.jobs, id)
+		}
+		a.jobsMu.Unlock()
+		log.Default().Printf("Agent %s disconnected", node.Name)
+	}()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(TunnelPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					conn.Close()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	conn.SetPongHandler(func(string) error {
+		a.seen()
+		return nil
+	})
+	a.seen()
+
+	for {
+		var msg TunnelMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		a.seen()
+
+		if msg.Type != "event" && msg.Type != "done" {
+			continue
+		}
+		a.jobsMu.Lock()
+		job, ok := a.jobs[msg.Job]
+		if ok && msg.Type == "done" {
+			delete(a.jobs, msg.Job)
+		}
+		a.jobsMu.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case job.messages <- msg:
+		case <-job.done:
+		}
+		if msg.Type == "done" {
+			close(job.messages)
+		}
+	}
+}
+
+// runAgent runs method through the tunnel of an agent node
+func runAgent(ctx context.Context, node *nodes.Node, method string, query url.Values, relay func(event)) result {
+	agentsMu.RLock()
+	a, ok := agents[node.URL]
+	agentsMu.RUnlock()
+	if !ok {
+		return result{err: fmt.Errorf("agent is not connected")}
+	}
+
+	id := uuid.New().String()
+	job := &agentJob{
+		messages: make(chan TunnelMessage, 256),
+		done:     make(chan struct{}),
+	}
+	defer close(job.done)
+	a.jobsMu.Lock()
+	a.jobs[id] = job
+	a.jobsMu.Unlock()
+
+	if err := a.send(TunnelMessage{Type: "job", Job: id, Method: method, Query: query.Encode()}); err != nil {
+		a.jobsMu.Lock()
+		delete(a.jobs, id)
+		a.jobsMu.Unlock()
+		return result{err: err}
+	}
+
+	for {
+		select {
+		case msg, ok := <-job.messages:
+			if !ok {
+				return result{err: fmt.Errorf("agent disconnected")}
+			}
+			if msg.Type == "done" {
+				return result{status: msg.Status, body: []byte(msg.Body)}
+			}
+			if Relayed(method, msg.Name) {
+				relay(event{name: msg.Name, data: msg.Data})
+			}
+		case <-ctx.Done():
+			a.jobsMu.Lock()
+			delete(a.jobs, id)
+			a.jobsMu.Unlock()
+			a.send(TunnelMessage{Type: "cancel", Job: id})
+			return result{err: ctx.Err()}
+		}
+	}
+}
+
+// agentHealth reports an agent as online while its tunnel is open
+func agentHealth(node nodes.Node) *nodes.NodeHealth {
+	health := &nodes.NodeHealth{
+		Status:    "offline",
+		LastCheck: time.Now(),
+	}
+
+	agentsMu.RLock()
+	a, ok := agents[node.URL]
+	agentsMu.RUnlock()
+	if !ok {
+		health.Error = "agent is not connected"
+		return health
+	}
+
+	a.jobsMu.Lock()
+	lastSeen := a.lastSeen
+	a.jobsMu.Unlock()
+	health.Status = "online"
+	health.LastSeen = &lastSeen
+	return health
+}
@@ -2,6 +2,7 @@ package iperf3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller"
 	"github.com/X-Zero-L/als/config"
 )
 
@@ -23,12 +25,28 @@ func Handle(c *gin.Context) {
 	v, _ := c.Get("clientSession")
 	clientSession := v.(*client.ClientSession)
 
-	timeout := time.Second * 60
-	port := random(config.Config.Iperf3StartPort, config.Config.Iperf3EndPort)
+	timeout := time.Second * time.Duration(config.Get().ToolTimeout)
 
-	ctx, cancel := context.WithTimeout(clientSession.GetContext(c.Request.Context()), timeout)
+	// Wait for as long as the session lasts, the timeout only covers the run
+	queueCtx, done := client.WaitQueue(clientSession.GetContext(c.Request.Context()), controller.QueueJob(c, client.PoolIperf3, "iperf3", ""), nil)
+	defer done()
+	if queueCtx.Err() != nil {
+		message := "Stopped waiting in queue"
+		if cause := context.Cause(queueCtx); errors.Is(cause, client.ErrJobCancelled) {
+			message = cause.Error()
+		}
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   message,
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(queueCtx, timeout)
 	defer cancel()
 
+	port := random(config.Get().Iperf3StartPort, config.Get().Iperf3EndPort)
+
 	cmd := exec.CommandContext(ctx, "iperf3", "-s", "--forceflush", "-p", fmt.Sprintf("%d", port))
 	clientSession.Channel <- &client.Message{
 		Name:    "Iperf3",
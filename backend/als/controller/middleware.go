@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/config"
 )
 
 func MiddlewareSessionOnHeader() gin.HandlerFunc {
@@ -19,6 +20,7 @@ func MiddlewareSessionOnHeader() gin.HandlerFunc {
 			return
 		}
 		c.Set("clientSession", client)
+		c.Set("sessionId", sessionId)
 		c.Next()
 	}
 }
@@ -38,6 +40,38 @@ func MiddlewareSessionOnUrl() gin.HandlerFunc {
 			return
 		}
 		c.Set("clientSession", client)
+		c.Set("sessionId", sessionId)
 		c.Next()
 	}
 }
+
+// MiddlewareFeature rejects requests while the feature is disabled in the
+// current config, so features can be toggled by a config reload
+func MiddlewareFeature(enabled func(cfg *config.ALSConfig) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !enabled(config.Get()) {
+			c.JSON(404, &gin.H{
+				"success": false,
+				"error":   "Feature disabled",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// QueueJob describes the run of tool against target in pool for the session
+// of the request, as listed by the queue admin endpoint
+func QueueJob(c *gin.Context, pool string, tool string, target string) client.Job {
+	job := client.Job{
+		Pool:      pool,
+		Tool:      tool,
+		SessionID: c.GetString("sessionId"),
+		Target:    target,
+	}
+	if v, ok := c.Get("clientSession"); ok {
+		job.ClientIP = v.(*client.ClientSession).ClientIP
+	}
+	return job
+}
@@ -2,6 +2,7 @@ package nettools
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -9,9 +10,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller"
+	"github.com/X-Zero-L/als/als/target"
+	"github.com/X-Zero-L/als/config"
 	"github.com/gin-gonic/gin"
 )
 
@@ -21,8 +24,9 @@ type NetworkTool struct {
 	Command   string
 	Args      []string
 	IPv6      bool
-	Timeout   time.Duration
+	Settings  config.ToolConfig
 	EventName string
+	Pool      string // queue pool the runs wait in
 }
 
 // GetNetworkTools returns available network tools
@@ -31,38 +35,75 @@ func GetNetworkTools() map[string]NetworkTool {
 		"mtr": {
 			Name:      "mtr",
 			Command:   "mtr",
-			Args:      []string{"--report", "--report-cycles", "10", "--no-dns"},
+			Args:      []string{"--report", "--no-dns"},
 			IPv6:      false,
-			Timeout:   60 * time.Second,
+			Settings:  config.Get().MTR,
 			EventName: "MTROutput",
+			Pool:      client.PoolMTR,
 		},
 		"mtr6": {
 			Name:      "mtr6",
 			Command:   "mtr",
-			Args:      []string{"--report", "--report-cycles", "10", "--no-dns", "-6"},
+			Args:      []string{"--report", "--no-dns", "-6"},
 			IPv6:      true,
-			Timeout:   60 * time.Second,
+			Settings:  config.Get().MTR,
 			EventName: "MTR6Output",
+			Pool:      client.PoolMTR,
 		},
 		"traceroute": {
 			Name:      "traceroute",
 			Command:   "traceroute",
 			Args:      []string{},
 			IPv6:      false,
-			Timeout:   60 * time.Second,
+			Settings:  config.Get().Traceroute,
 			EventName: "TracerouteOutput",
+			Pool:      client.PoolTraceroute,
 		},
 		"traceroute6": {
 			Name:      "traceroute6",
 			Command:   "traceroute6",
 			Args:      []string{},
 			IPv6:      true,
-			Timeout:   60 * time.Second,
+			Settings:  config.Get().Traceroute,
 			EventName: "Traceroute6Output",
+			Pool:      client.PoolTraceroute,
 		},
 	}
 }
 
+// buildArgs returns the command line arguments for a run against ip
+func (t NetworkTool) buildArgs(ip string, params *controller.ToolParams) []string {
+	args := append([]string{}, t.Args...)
+	if !t.IPv6 && net.ParseIP(ip).To4() == nil {
+		// An IPv6 address was picked for an IPv4 tool with family=6 or auto
+		args = append(args, "-6")
+	}
+
+	if t.Command == "mtr" {
+		args = append(args, "--report-cycles", strconv.Itoa(params.Count))
+		if params.Interval > 0 {
+			args = append(args, "--interval", strconv.FormatFloat(params.Interval.Seconds(), 'f', -1, 64))
+		}
+		if params.PacketSize > 0 {
+			args = append(args, "--psize", strconv.Itoa(params.PacketSize))
+		}
+		if params.MaxHops > 0 {
+			args = append(args, "--max-ttl", strconv.Itoa(params.MaxHops))
+		}
+		return append(args, ip)
+	}
+
+	// traceroute [-m max_hops] host [packetlen]
+	if params.MaxHops > 0 {
+		args = append(args, "-m", strconv.Itoa(params.MaxHops))
+	}
+	args = append(args, ip)
+	if params.PacketSize > 0 {
+		args = append(args, strconv.Itoa(params.PacketSize))
+	}
+	return args
+}
+
 // HandleNetworkTool handles network tool requests
 func HandleNetworkTool(toolName string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -105,19 +146,63 @@ func HandleNetworkTool(toolName string) gin.HandlerFunc {
 			return
 		}
 
-		// Create timeout context
-		timeout := tool.Timeout
-		ctx, cancel := context.WithTimeout(clientSession.GetContext(c.Request.Context()), timeout)
+		params, err := controller.ParseToolParams(c, tool.Settings)
+		if err != nil {
+			c.JSON(400, &gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		// The IPv6 tools are bound to their family, the others default to IPv4
+		family := c.DefaultQuery("family", target.FamilyIPv4)
+		if tool.IPv6 {
+			family = target.FamilyIPv6
+		}
+		addr, ok := controller.ResolveTarget(c, tool.Name, ip, family)
+		if !ok {
+			return
+		}
+
+		// Wait for as long as the session lasts, the timeout only covers the run
+		sessionCtx := clientSession.GetContext(c.Request.Context())
+		queueCtx, done := client.WaitQueue(sessionCtx, controller.QueueJob(c, tool.Pool, tool.Name, ip), func(pos int, totalPos int) {
+			select {
+			case clientSession.Channel <- &client.Message{
+				Name:    tool.EventName,
+				Content: fmt.Sprintf(`{"output":"Waiting in queue (%d/%d)...\n","finished":false}`, pos, totalPos),
+			}:
+			case <-sessionCtx.Done():
+			}
+		})
+		defer done()
+		if queueCtx.Err() != nil {
+			message := "Stopped waiting in queue"
+			if cause := context.Cause(queueCtx); errors.Is(cause, client.ErrJobCancelled) {
+				message = cause.Error()
+			}
+			c.JSON(400, &gin.H{
+				"success": false,
+				"error":   message,
+			})
+			return
+		}
+
+		runCtx, cancel := context.WithTimeout(queueCtx, params.Timeout)
 		defer cancel()
 
 		// Build command
-		args := append(tool.Args, ip)
-		cmd := exec.CommandContext(ctx, tool.Command, args...)
+		cmd := exec.CommandContext(runCtx, tool.Command, tool.buildArgs(addr, params)...)
 
 		// Send start message
+		destination := ip
+		if addr != ip {
+			destination = fmt.Sprintf("%s (%s)", ip, addr)
+		}
 		clientSession.Channel <- &client.Message{
 			Name:    tool.EventName,
-			Content: fmt.Sprintf(`{"output":"Starting %s to %s...\n","finished":false}`, tool.Name, ip),
+			Content: fmt.Sprintf(`{"output":"Starting %s to %s...\n","finished":false}`, tool.Name, destination),
 		}
 
 		// Writer function (exactly like iperf3)
@@ -142,7 +227,7 @@ func HandleNetworkTool(toolName string) gin.HandlerFunc {
 		go writer(cmd.StdoutPipe())
 		go writer(cmd.StderrPipe())
 
-		err := cmd.Start()
+		err = cmd.Start()
 		if err != nil {
 			c.JSON(400, &gin.H{
 				"success": false,
@@ -153,6 +238,14 @@ func HandleNetworkTool(toolName string) gin.HandlerFunc {
 
 		cmd.Wait()
 
+		// Tell why the run was cut short by the queue
+		if cause := context.Cause(runCtx); errors.Is(cause, client.ErrJobCancelled) || errors.Is(cause, client.ErrJobTimeout) {
+			clientSession.Channel <- &client.Message{
+				Name:    tool.EventName,
+				Content: fmt.Sprintf(`{"output":%s,"finished":false}`, strconv.Quote("\n"+cause.Error()+"\n")),
+			}
+		}
+
 		// Send completion message
 		clientSession.Channel <- &client.Message{
 			Name:    tool.EventName,
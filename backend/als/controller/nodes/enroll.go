@@ -0,0 +1,259 @@
+package nodes
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Heartbeats of enrolled nodes by node ID. They are only kept in memory, after
+// a restart every enrolled node counts as seen at startup.
+var (
+	heartbeats   = make(map[string]time.Time)
+	heartbeatsMu sync.RWMutex
+	startedAt    = time.Now().UTC().Truncate(time.Second)
+)
+
+func recordHeartbeat(id string) {
+	heartbeatsMu.Lock()
+	heartbeats[id] = time.Now().UTC().Truncate(time.Second)
+	heartbeatsMu.Unlock()
+}
+
+// getHeartbeat returns the time of the last heartbeat of the node
+func getHeartbeat(id string) time.Time {
+	heartbeatsMu.RLock()
+	defer heartbeatsMu.RUnlock()
+	if at, ok := heartbeats[id]; ok {
+		return at
+	}
+	return startedAt
+}
+
+func isStale(lastHeartbeat time.Time) bool {
+	return time.Since(lastHeartbeat) > time.Duration(config.Get().NodeStaleAfter)*time.Second
+}
+
+// EnrollNode registers the calling node, or refreshes it if it enrolled
+// before with the same URL and token. Nodes added by an admin or enrolled
+// with another token cannot be taken over, and deleted nodes stay deleted
+// until an admin restores them.
+func EnrollNode(c *gin.Context) {
+	var req NodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	// agent:// URLs belong to agents connected through the tunnel
+	if !isNodeURL(req.URL) || strings.HasPrefix(req.URL, AgentURLPrefix) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "url must be an http or https URL",
+		})
+		return
+	}
+
+	if err := normalizeMetadata(&req.NodeMetadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	existing, err := findByURL(req.URL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	status := http.StatusCreated
+	if existing == nil {
+		err = storage.AddNode(Node{
+			Name:         req.Name,
+			Location:     req.Location,
+			URL:          req.URL,
+			ApiKey:       req.ApiKey,
+			NodeMetadata: req.NodeMetadata,
+			Enrolled:     true,
+			OwnerTokenID: TokenID(c),
+		})
+		if err == nil {
+			existing, err = findByURL(req.URL)
+		}
+	} else if !existing.Enrolled {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   fmt.Sprintf("node with URL '%s' already exists", req.URL),
+		})
+		return
+	} else if existing.DeletedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   fmt.Sprintf("node with URL '%s' was deleted, an admin must restore it before it can enroll again", req.URL),
+		})
+		return
+	} else {
+		var other bool
+		other, err = ownedByOther(existing, TokenID(c))
+		if other {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   fmt.Sprintf("node with URL '%s' was enrolled with another token", req.URL),
+			})
+			return
+		}
+		if err == nil {
+			status = http.StatusOK
+			existing.OwnerTokenID = TokenID(c)
+			refreshEnrolled(existing, req)
+			err = storage.UpdateNode(existing.ID, *existing)
+		}
+	}
+
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	recordHeartbeat(existing.ID)
+	c.JSON(status, gin.H{
+		"success": true,
+		"node_id": existing.ID,
+	})
+}
+
+// refreshEnrolled applies what an enrolled node sent again. Metadata it left
+// empty keeps the value an admin may have set since.
+func refreshEnrolled(node *Node, req NodeRequest) {
+	node.Name = req.Name
+	node.Location = req.Location
+	if req.ApiKey != "" {
+		node.ApiKey = req.ApiKey
+	}
+
+	m := req.NodeMetadata
+	if m.CountryCode != "" {
+		node.CountryCode = m.CountryCode
+	}
+	if m.Region != "" {
+		node.Region = m.Region
+	}
+	if m.Provider != "" {
+		node.Provider = m.Provider
+	}
+	if m.ASN != "" {
+		node.ASN = m.ASN
+	}
+	if len(m.Tags) > 0 {
+		node.Tags = m.Tags
+	}
+	if m.IPv4 != nil {
+		node.IPv4 = m.IPv4
+	}
+	if m.IPv6 != nil {
+		node.IPv6 = m.IPv6
+	}
+	if len(m.Features) > 0 {
+		node.Features = m.Features
+	}
+}
+
+// Heartbeat records that an enrolled node is alive, only the token it
+// enrolled with may send them. A 404 tells the node it was removed and has
+// to enroll again.
+func Heartbeat(c *gin.Context) {
+	node, err := Lookup(c.Param("id"))
+	if err != nil {
+		if err.Error() == "node not found" {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "Node not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return
+	}
+	if !node.Enrolled {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "Node was not enrolled",
+		})
+		return
+	}
+	if other, err := ownedByOther(node, TokenID(c)); err != nil || other {
+		status, message := http.StatusForbidden, "Node was enrolled with another token"
+		if err != nil {
+			status, message = http.StatusInternalServerError, err.Error()
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   message,
+		})
+		return
+	}
+
+	recordHeartbeat(node.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+	})
+}
+
+// RunEnrollmentExpiry periodically removes the enrolled nodes whose last
+// heartbeat is older than node_expire_after. Nodes an admin deleted are left
+// alone, removing them would let them enroll again.
+func RunEnrollmentExpiry() {
+	for {
+		time.Sleep(30 * time.Second)
+
+		expireAfter := time.Duration(config.Get().NodeExpireAfter) * time.Second
+		if expireAfter == 0 {
+			continue
+		}
+
+		all, err := storage.GetNodes()
+		if err != nil {
+			continue
+		}
+		for _, node := range all {
+			if !node.Enrolled || node.DeletedAt != nil || time.Since(getHeartbeat(node.ID)) <= expireAfter {
+				continue
+			}
+			if err := storage.DeleteNode(node.ID); err != nil {
+				log.Default().Printf("WARN: Failed to remove expired node %s: %v", node.Name, err)
+				continue
+			}
+			heartbeatsMu.Lock()
+			delete(heartbeats, node.ID)
+			heartbeatsMu.Unlock()
+			log.Default().Printf("Removed node %s, no heartbeat for %s", node.Name, expireAfter)
+		}
+	}
+}
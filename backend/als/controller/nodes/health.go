@@ -0,0 +1,154 @@
+package nodes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// NodeHealth is the result of the latest probe of a node
+type NodeHealth struct {
+	Status    string     `json:"status"` // "online", "offline"
+	LastCheck time.Time  `json:"last_check"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Latency   int64      `json:"latency"` // in milliseconds
+	Error     string     `json:"error,omitempty"`
+}
+
+var (
+	healthByURL = make(map[string]*NodeHealth)
+	healthMu    sync.RWMutex
+)
+
+// AgentHealth reports the health of a reverse-connected agent, which cannot
+// be probed over HTTP. It is set by the federation package.
+var AgentHealth func(node Node) *NodeHealth
+
+// getHealth returns a copy of the latest probe result of the node at url
+func getHealth(url string) *NodeHealth {
+	healthMu.RLock()
+	defer healthMu.RUnlock()
+	h, ok := healthByURL[url]
+	if !ok {
+		return nil
+	}
+	health := *h
+	return &health
+}
+
+// RunHealthCheck periodically probes every registered node that is not
+// disabled
+func RunHealthCheck() {
+	for {
+		interval := config.Get().NodeHealthInterval
+		if interval > 0 {
+			checkNodes(visibleNodes())
+		} else {
+			// Disabled, look again later in case the config is reloaded
+			interval = 60
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+func checkNodes(nodes []Node) {
+	httpClient := &http.Client{
+		Timeout: time.Duration(config.Get().NodeHealthTimeout) * time.Second,
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*NodeHealth, len(nodes))
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node Node) {
+			defer wg.Done()
+			results[i] = probeNode(httpClient, node)
+		}(i, node)
+	}
+	wg.Wait()
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	previous := healthByURL
+	healthByURL = make(map[string]*NodeHealth, len(nodes))
+	for i, node := range nodes {
+		health := results[i]
+		if health.LastSeen == nil {
+			if old, ok := previous[node.URL]; ok {
+				health.LastSeen = old.LastSeen
+			}
+		}
+		healthByURL[node.URL] = health
+	}
+}
+
+// probeNode requests /nodes/current of the node
+func probeNode(httpClient *http.Client, node Node) *NodeHealth {
+	if node.IsAgent() && AgentHealth != nil {
+		return AgentHealth(node)
+	}
+
+	health := &NodeHealth{
+		Status:    "offline",
+		LastCheck: time.Now(),
+	}
+
+	start := time.Now()
+	resp, err := httpClient.Get(strings.TrimRight(node.URL, "/") + "/nodes/current")
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+
+	var body struct {
+		Success bool `json:"success"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		health.Error = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		return health
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || !body.Success {
+		health.Error = "unexpected response"
+		return health
+	}
+
+	health.Status = "online"
+	health.Latency = latency.Milliseconds()
+	health.LastSeen = &health.LastCheck
+	return health
+}
+
+// GetNodesHealth returns the latest probe result of every node that is not
+// disabled
+func GetNodesHealth(c *gin.Context) {
+	type nodeHealth struct {
+		ID     string      `json:"id,omitempty"`
+		Name   string      `json:"name"`
+		URL    string      `json:"url"`
+		Health *NodeHealth `json:"health"`
+	}
+
+	result := []nodeHealth{}
+	for _, node := range visibleNodes() {
+		result = append(result, nodeHealth{
+			ID:     node.ID,
+			Name:   node.Name,
+			URL:    node.URL,
+			Health: getHealth(node.URL),
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"success":  true,
+		"interval": config.Get().NodeHealthInterval,
+		"nodes":    result,
+	})
+}
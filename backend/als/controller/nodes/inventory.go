@@ -0,0 +1,592 @@
+package nodes
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// inventoryColumns are the CSV columns of an export, in order. An import
+// needs at least name, location and url.
+var inventoryColumns = []string{"id", "name", "location", "url", "country_code", "region", "provider", "asn", "tags", "ipv4", "ipv6", "features", "weight", "state", "state_message"}
+
+// maxImportSize limits the size of an import body
+const maxImportSize = 10 << 20
+
+// inventoryNode is a node as exported and imported, without its API key
+type inventoryNode struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	URL      string `json:"url"`
+	config.NodeMetadata
+	Weight       int    `json:"weight,omitempty"`
+	State        string `json:"state,omitempty"`
+	StateMessage string `json:"state_message,omitempty"`
+
+	row int // 1-based entry of a JSON or LG_NODES import, line of a CSV import
+}
+
+// importError is a problem with one row of an import
+type importError struct {
+	Row   int    `json:"row,omitempty"`
+	Error string `json:"error"`
+}
+
+// fieldChange is the old and new value of a node field
+type fieldChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// nodeChange describes what an import does to one node
+type nodeChange struct {
+	Row     int                    `json:"row,omitempty"`
+	ID      string                 `json:"id,omitempty"`
+	Name    string                 `json:"name"`
+	URL     string                 `json:"url"`
+	Changes map[string]fieldChange `json:"changes,omitempty"`
+
+	node Node
+}
+
+// importPlan is the diff between the stored nodes and an import
+type importPlan struct {
+	Created   []nodeChange `json:"created"`
+	Updated   []nodeChange `json:"updated"`
+	Deleted   []nodeChange `json:"deleted"`
+	Unchanged int          `json:"unchanged"`
+}
+
+// ExportNodes returns the API-managed nodes that are not deleted as JSON, or
+// as CSV with format=csv
+func ExportNodes(c *gin.Context) {
+	all, err := storage.GetNodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	inventory := []inventoryNode{}
+	for _, n := range withoutDeleted(all) {
+		inventory = append(inventory, inventoryNode{
+			ID:           n.ID,
+			Name:         n.Name,
+			Location:     n.Location,
+			URL:          n.URL,
+			NodeMetadata: n.NodeMetadata,
+			Weight:       n.Weight,
+			State:        n.State,
+			StateMessage: n.StateMessage,
+		})
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"nodes":   inventory,
+		})
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write(inventoryColumns)
+		for _, n := range inventory {
+			w.Write([]string{
+				n.ID, n.Name, n.Location, n.URL, n.CountryCode, n.Region, n.Provider, n.ASN,
+				strings.Join(n.Tags, ","), formatBool(n.IPv4), formatBool(n.IPv6), strings.Join(n.Features, ","),
+				strconv.Itoa(n.Weight), n.State, n.StateMessage,
+			})
+		}
+		w.Flush()
+		c.Header("Content-Disposition", `attachment; filename="nodes.csv"`)
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "format must be json or csv",
+		})
+	}
+}
+
+// ImportNodes synchronizes the API-managed nodes with a node list sent as
+// JSON, CSV or in the LG_NODES format. Nodes are matched by ID, then URL, then
+// name, deleted nodes that are matched are restored. mode=merge (default)
+// creates and updates nodes, mode=replace also deletes the nodes missing from
+// the list, except the ones that registered themselves. Nothing is changed if
+// a row is invalid or with dry_run=true.
+func ImportNodes(c *gin.Context) {
+	mode := c.DefaultQuery("mode", "merge")
+	if mode != "merge" && mode != "replace" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "mode must be merge or replace",
+		})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxImportSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	format := c.Query("format")
+	if format == "" {
+		switch c.ContentType() {
+		case "text/csv":
+			format = "csv"
+		case "text/plain":
+			format = "lg_nodes"
+		default:
+			format = "json"
+		}
+	}
+
+	var inventory []inventoryNode
+	var problems []importError
+	switch format {
+	case "json":
+		inventory, err = parseInventoryJSON(data)
+	case "csv":
+		inventory, problems, err = parseInventoryCSV(data)
+	case "lg_nodes":
+		inventory, problems = parseInventoryLGNodes(string(data))
+	default:
+		err = fmt.Errorf("format must be json, csv or lg_nodes")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	existing, err := storage.GetNodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	plan, planProblems := planImport(existing, inventory, mode == "replace")
+	problems = append(problems, planProblems...)
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool { return problems[i].Row < problems[j].Row })
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "Invalid rows, nothing was imported",
+			"errors":  problems,
+		})
+		return
+	}
+
+	if dryRun {
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"dry_run": true,
+			"plan":    plan,
+		})
+		return
+	}
+
+	// All or nothing, so nodes may also swap names or URLs
+	var batch NodeBatch
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, change := range plan.Deleted {
+		node := change.node
+		node.DeletedAt = &now
+		batch.Update = append(batch.Update, node)
+	}
+	for _, change := range plan.Updated {
+		batch.Update = append(batch.Update, change.node)
+	}
+	for _, change := range plan.Created {
+		batch.Add = append(batch.Add, change.node)
+	}
+
+	if err := storage.ApplyBatch(batch); err != nil {
+		status := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "already exists") {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   "Import failed, nothing was imported: " + err.Error(),
+			"plan":    plan,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"plan":    plan,
+	})
+}
+
+// planImport validates the inventory against the stored nodes and works out
+// the changes to apply
+func planImport(existing []Node, inventory []inventoryNode, replace bool) (importPlan, []importError) {
+	plan := importPlan{Created: []nodeChange{}, Updated: []nodeChange{}, Deleted: []nodeChange{}}
+	var problems []importError
+	fail := func(row int, format string, a ...interface{}) {
+		problems = append(problems, importError{Row: row, Error: fmt.Sprintf(format, a...)})
+	}
+
+	byID := make(map[string]*Node)
+	byURL := make(map[string]*Node)
+	byName := make(map[string]*Node)
+	for i := range existing {
+		n := &existing[i]
+		byID[n.ID] = n
+		byURL[n.URL] = n
+		byName[n.Name] = n
+	}
+
+	seenID := make(map[string]int)
+	seenName := make(map[string]int)
+	seenURL := make(map[string]int)
+	matched := make(map[string]bool)
+
+	type planned struct {
+		item  inventoryNode
+		match *Node
+	}
+	var rows []planned
+
+	for _, item := range inventory {
+		item.ID = strings.TrimSpace(item.ID)
+		item.Name = strings.TrimSpace(item.Name)
+		item.Location = strings.TrimSpace(item.Location)
+		item.URL = strings.TrimSpace(item.URL)
+
+		if item.Name == "" || item.Location == "" || item.URL == "" {
+			fail(item.row, "name, location and url are required")
+			continue
+		}
+		if !isNodeURL(item.URL) {
+			fail(item.row, "url '%s' is not an http(s) URL", item.URL)
+			continue
+		}
+		if err := normalizeMetadata(&item.NodeMetadata); err != nil {
+			fail(item.row, "%v", err)
+			continue
+		}
+		state, stateMessage, err := normalizeState(item.State, item.StateMessage)
+		if err != nil {
+			fail(item.row, "%v", err)
+			continue
+		}
+		item.State, item.StateMessage = state, stateMessage
+
+		duplicate := false
+		for _, seen := range []struct {
+			rows  map[string]int
+			field string
+			value string
+		}{{seenID, "id", item.ID}, {seenName, "name", item.Name}, {seenURL, "url", item.URL}} {
+			if seen.value == "" {
+				continue
+			}
+			if row, ok := seen.rows[seen.value]; ok {
+				fail(item.row, "duplicate %s '%s', also in row %d", seen.field, seen.value, row)
+				duplicate = true
+			}
+			seen.rows[seen.value] = item.row
+		}
+		if duplicate {
+			continue
+		}
+
+		var match *Node
+		switch {
+		case item.ID != "":
+			match = byID[item.ID]
+		case byURL[item.URL] != nil:
+			match = byURL[item.URL]
+		default:
+			match = byName[item.Name]
+		}
+		if match != nil {
+			if matched[match.ID] {
+				fail(item.row, "node %s is matched by another row", match.ID)
+				continue
+			}
+			matched[match.ID] = true
+		}
+		rows = append(rows, planned{item, match})
+	}
+
+	// Unmatched nodes keep their name and URL, even once deleted, the rows
+	// may not take them
+	staying := func(n *Node) bool {
+		return n != nil && !matched[n.ID]
+	}
+	for _, r := range rows {
+		if n := byName[r.item.Name]; staying(n) {
+			fail(r.item.row, "node with name '%s' already exists", r.item.Name)
+		} else if n := byURL[r.item.URL]; staying(n) {
+			fail(r.item.row, "node with URL '%s' already exists", r.item.URL)
+		}
+	}
+	if len(problems) > 0 {
+		return plan, problems
+	}
+
+	for _, r := range rows {
+		node := Node{
+			ID:           r.item.ID,
+			Name:         r.item.Name,
+			Location:     r.item.Location,
+			URL:          r.item.URL,
+			NodeMetadata: r.item.NodeMetadata,
+			Weight:       r.item.Weight,
+			State:        r.item.State,
+			StateMessage: r.item.StateMessage,
+		}
+		change := nodeChange{Row: r.item.row, ID: node.ID, Name: node.Name, URL: node.URL, node: node}
+
+		if r.match == nil {
+			plan.Created = append(plan.Created, change)
+			continue
+		}
+
+		node.ID = r.match.ID
+		node.ApiKey = r.match.ApiKey
+		node.Enrolled = r.match.Enrolled
+		node.OwnerTokenID = r.match.OwnerTokenID
+		change.ID, change.node = node.ID, node
+		change.Changes = diffNodes(*r.match, node)
+		if len(change.Changes) == 0 {
+			plan.Unchanged++
+		} else {
+			plan.Updated = append(plan.Updated, change)
+		}
+	}
+
+	if replace {
+		for _, n := range existing {
+			if !matched[n.ID] && n.DeletedAt == nil && !n.Enrolled && !n.IsAgent() {
+				plan.Deleted = append(plan.Deleted, nodeChange{ID: n.ID, Name: n.Name, URL: n.URL, node: n})
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// diffNodes returns the inventory fields that differ between old and updated
+func diffNodes(old Node, updated Node) map[string]fieldChange {
+	changes := make(map[string]fieldChange)
+	compare := func(field string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changes[field] = fieldChange{Old: a, New: b}
+		}
+	}
+
+	compare("name", old.Name, updated.Name)
+	compare("location", old.Location, updated.Location)
+	compare("url", old.URL, updated.URL)
+	compare("country_code", old.CountryCode, updated.CountryCode)
+	compare("region", old.Region, updated.Region)
+	compare("provider", old.Provider, updated.Provider)
+	compare("asn", old.ASN, updated.ASN)
+	compare("tags", normalizeList(old.Tags), updated.Tags)
+	compare("ipv4", derefBool(old.IPv4), derefBool(updated.IPv4))
+	compare("ipv6", derefBool(old.IPv6), derefBool(updated.IPv6))
+	compare("features", normalizeList(old.Features), updated.Features)
+	compare("weight", old.Weight, updated.Weight)
+	compare("state", old.State, updated.State)
+	compare("state_message", old.StateMessage, updated.StateMessage)
+	compare("deleted", old.DeletedAt != nil, updated.DeletedAt != nil)
+	return changes
+}
+
+func parseInventoryJSON(data []byte) ([]inventoryNode, error) {
+	// Accept the output of the JSON export as well as a plain list
+	var inventory []inventoryNode
+	if err := json.Unmarshal(data, &inventory); err != nil {
+		var export struct {
+			Nodes []inventoryNode `json:"nodes"`
+		}
+		if json.Unmarshal(data, &export) != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		inventory = export.Nodes
+	}
+	for i := range inventory {
+		inventory[i].row = i + 1
+	}
+	return inventory, nil
+}
+
+func parseInventoryCSV(data []byte) ([]inventoryNode, []importError, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !contains(inventoryColumns, name) {
+			return nil, nil, fmt.Errorf("unknown CSV column '%s', expected %s", name, strings.Join(inventoryColumns, ", "))
+		}
+		columns[name] = i
+	}
+	for _, required := range []string{"name", "location", "url"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, fmt.Errorf("CSV column '%s' is required", required)
+		}
+	}
+
+	var inventory []inventoryNode
+	var problems []importError
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return nil, nil, fmt.Errorf("invalid CSV on line %d: %v", parseErr.StartLine, parseErr.Err)
+			}
+			return nil, nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		// Only valid once Read succeeded
+		line, _ := r.FieldPos(0)
+
+		get := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		item := inventoryNode{
+			ID:       get("id"),
+			Name:     get("name"),
+			Location: get("location"),
+			URL:      get("url"),
+			NodeMetadata: config.NodeMetadata{
+				CountryCode: get("country_code"),
+				Region:      get("region"),
+				Provider:    get("provider"),
+				ASN:         get("asn"),
+				Tags:        splitList(get("tags")),
+				Features:    splitList(get("features")),
+			},
+			State:        get("state"),
+			StateMessage: get("state_message"),
+			row:          line,
+		}
+
+		if item.IPv4, err = parseOptionalBool(get("ipv4")); err != nil {
+			problems = append(problems, importError{Row: line, Error: "ipv4 must be true or false"})
+			continue
+		}
+		if item.IPv6, err = parseOptionalBool(get("ipv6")); err != nil {
+			problems = append(problems, importError{Row: line, Error: "ipv6 must be true or false"})
+			continue
+		}
+		if v := get("weight"); v != "" {
+			if item.Weight, err = strconv.Atoi(v); err != nil {
+				problems = append(problems, importError{Row: line, Error: "weight must be an integer"})
+				continue
+			}
+		}
+		inventory = append(inventory, item)
+	}
+	return inventory, problems, nil
+}
+
+// parseInventoryLGNodes parses the legacy LG_NODES format "name|location|url;..."
+func parseInventoryLGNodes(data string) ([]inventoryNode, []importError) {
+	var inventory []inventoryNode
+	var problems []importError
+	for i, entry := range strings.Split(strings.TrimSpace(data), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.Split(entry, "|")
+		if len(parts) < 3 {
+			problems = append(problems, importError{Row: i + 1, Error: "expected name|location|url"})
+			continue
+		}
+		inventory = append(inventory, inventoryNode{
+			Name:     parts[0],
+			Location: parts[1],
+			URL:      parts[2],
+			row:      i + 1,
+		})
+	}
+	return inventory, problems
+}
+
+// isNodeURL reports whether u is an http(s) URL or the URL of an agent
+func isNodeURL(u string) bool {
+	if strings.HasPrefix(u, AgentURLPrefix) {
+		return true
+	}
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+func parseOptionalBool(v string) (*bool, error) {
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func formatBool(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+func derefBool(b *bool) interface{} {
+	if b == nil {
+		return nil
+	}
+	return *b
+}
@@ -0,0 +1,181 @@
+package nodes
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// knownFeatures are the tools a node may advertise
+var knownFeatures = []string{"ping", "mtr", "traceroute", "iperf3", "speedtest", "librespeed", "filespeedtest", "shell"}
+
+var countryCodeRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// normalizeMetadata trims and lower/upper-cases the metadata fields and
+// rejects unknown values
+func normalizeMetadata(m *config.NodeMetadata) error {
+	m.CountryCode = strings.ToUpper(strings.TrimSpace(m.CountryCode))
+	if m.CountryCode != "" && !countryCodeRegex.MatchString(m.CountryCode) {
+		return fmt.Errorf("invalid country code '%s', expected ISO 3166-1 alpha-2", m.CountryCode)
+	}
+
+	m.Region = strings.TrimSpace(m.Region)
+	m.Provider = strings.TrimSpace(m.Provider)
+
+	m.ASN = strings.ToUpper(strings.TrimSpace(m.ASN))
+	if m.ASN != "" {
+		if !strings.HasPrefix(m.ASN, "AS") {
+			m.ASN = "AS" + m.ASN
+		}
+		if _, err := strconv.ParseUint(m.ASN[2:], 10, 32); err != nil {
+			return fmt.Errorf("invalid ASN '%s'", m.ASN)
+		}
+	}
+
+	m.Tags = normalizeList(m.Tags)
+
+	m.Features = normalizeList(m.Features)
+	for _, feature := range m.Features {
+		if !contains(knownFeatures, feature) {
+			return fmt.Errorf("unknown feature '%s', expected one of %s", feature, strings.Join(knownFeatures, ", "))
+		}
+	}
+
+	return nil
+}
+
+// normalizeList lower-cases, trims and de-duplicates the items of list
+func normalizeList(list []string) []string {
+	var result []string
+	for _, item := range list {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" && !contains(result, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// metadataFromQuery reads the metadata of a node from query parameters,
+// tags and features are comma separated
+func metadataFromQuery(c *gin.Context) (config.NodeMetadata, error) {
+	m := config.NodeMetadata{
+		CountryCode: c.Query("country_code"),
+		Region:      c.Query("region"),
+		Provider:    c.Query("provider"),
+		ASN:         c.Query("asn"),
+	}
+	if v := c.Query("tags"); v != "" {
+		m.Tags = strings.Split(v, ",")
+	}
+	if v := c.Query("features"); v != "" {
+		m.Features = strings.Split(v, ",")
+	}
+
+	var err error
+	if m.IPv4, err = queryBool(c, "ipv4"); err != nil {
+		return m, err
+	}
+	if m.IPv6, err = queryBool(c, "ipv6"); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+func queryBool(c *gin.Context, name string) (*bool, error) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+	return &b, nil
+}
+
+// nodeFilter selects nodes by the query parameters of GET /nodes
+type nodeFilter struct {
+	countryCode string
+	region      string
+	provider    string
+	asn         string
+	tags        []string
+	features    []string
+	ipv4        *bool
+	ipv6        *bool
+}
+
+func filterFromQuery(c *gin.Context) (*nodeFilter, error) {
+	m, err := metadataFromQuery(c)
+	if err != nil {
+		return nil, err
+	}
+	// Accept the singular forms as well, e.g. ?tag=anycast&feature=mtr
+	if v := c.Query("tag"); v != "" {
+		m.Tags = append(m.Tags, strings.Split(v, ",")...)
+	}
+	if v := c.Query("feature"); v != "" {
+		m.Features = append(m.Features, strings.Split(v, ",")...)
+	}
+	if v := c.Query("country"); v != "" && m.CountryCode == "" {
+		m.CountryCode = v
+	}
+
+	return &nodeFilter{
+		countryCode: strings.ToUpper(strings.TrimSpace(m.CountryCode)),
+		region:      strings.TrimSpace(m.Region),
+		provider:    strings.TrimSpace(m.Provider),
+		asn:         strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(m.ASN)), "AS"),
+		tags:        normalizeList(m.Tags),
+		features:    normalizeList(m.Features),
+		ipv4:        m.IPv4,
+		ipv6:        m.IPv6,
+	}, nil
+}
+
+// match reports whether node satisfies every condition of the filter
+func (f *nodeFilter) match(node Node) bool {
+	if f.countryCode != "" && node.CountryCode != f.countryCode {
+		return false
+	}
+	if f.region != "" && !strings.EqualFold(node.Region, f.region) {
+		return false
+	}
+	if f.provider != "" && !strings.EqualFold(node.Provider, f.provider) {
+		return false
+	}
+	if f.asn != "" && strings.TrimPrefix(node.ASN, "AS") != f.asn {
+		return false
+	}
+	for _, tag := range f.tags {
+		if !contains(node.Tags, tag) {
+			return false
+		}
+	}
+	for _, feature := range f.features {
+		if !contains(node.Features, feature) {
+			return false
+		}
+	}
+	if f.ipv4 != nil && (node.IPv4 == nil || *node.IPv4 != *f.ipv4) {
+		return false
+	}
+	if f.ipv6 != nil && (node.IPv6 == nil || *node.IPv6 != *f.ipv6) {
+		return false
+	}
+	return true
+}
+
+func contains(slice []string, item string) bool {
+	for _, a := range slice {
+		if a == item {
+			return true
+		}
+	}
+	return false
+}
@@ -5,23 +5,61 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/X-Zero-L/als/config"
 	"github.com/gin-gonic/gin"
 )
 
 // Node represents a Looking Glass node
 type Node struct {
-	ID       string `json:"id,omitempty"`       // 用于API管理的唯一ID
+	ID       string `json:"id,omitempty"` // 用于API管理的唯一ID
 	Name     string `json:"name"`
 	Location string `json:"location"`
 	URL      string `json:"url"`
 	Current  bool   `json:"current"`
-	ApiKey   string `json:"api_key,omitempty"`  // 仅在创建/更新时使用
+	ApiKey   string `json:"api_key,omitempty"` // 联邦模式下访问该节点的令牌，仅在创建/更新时使用
+	config.NodeMetadata
+	Weight        int         `json:"weight,omitempty"`         // sort order, lower weights come first
+	State         string      `json:"state,omitempty"`          // enabled (the default), disabled or maintenance
+	StateMessage  string      `json:"state_message,omitempty"`  // e.g. a maintenance notice
+	DeletedAt     *time.Time  `json:"deleted_at,omitempty"`     // when the node was moved to the recycle bin
+	Enrolled      bool        `json:"enrolled,omitempty"`       // the node registered itself and is removed when its heartbeats stop
+	OwnerTokenID  string      `json:"owner_token_id,omitempty"` // token an agent or enrolled node registered with
+	LastHeartbeat *time.Time  `json:"last_heartbeat,omitempty"`
+	Stale         bool        `json:"stale,omitempty"`     // enrolled node that missed its heartbeats
+	Federated     bool        `json:"federated,omitempty"` // tools can be run on it through this node
+	Health        *NodeHealth `json:"health,omitempty"`
+}
+
+// Node states, a node without state is enabled. Disabled nodes are hidden
+// from GET /nodes, nodes under maintenance are listed but not used.
+const (
+	StateEnabled     = "enabled"
+	StateDisabled    = "disabled"
+	StateMaintenance = "maintenance"
+)
+
+// Active reports whether tools can be run on the node
+func (n Node) Active() bool {
+	return n.State == "" && n.DeletedAt == nil
+}
+
+// AgentURLPrefix is the URL scheme of nodes connected through an agent tunnel
+const AgentURLPrefix = "agent://"
+
+// IsAgent reports whether the node dials in through an agent tunnel instead
+// of being reachable at its URL
+func (n Node) IsAgent() bool {
+	return strings.HasPrefix(n.URL, AgentURLPrefix)
 }
 
 // NodeRequest represents the request payload for node management
@@ -29,6 +67,11 @@ type NodeRequest struct {
 	Name     string `json:"name" binding:"required"`
 	Location string `json:"location" binding:"required"`
 	URL      string `json:"url" binding:"required"`
+	ApiKey   string `json:"api_key"`
+	config.NodeMetadata
+	Weight       int    `json:"weight"`
+	State        string `json:"state"`
+	StateMessage string `json:"state_message"`
 }
 
 // LatencyResponse represents the latency test result
@@ -45,11 +88,21 @@ type NodeStorage interface {
 	UpdateNode(id string, node Node) error
 	DeleteNode(id string) error
 	GetNode(id string) (*Node, error)
+	ApplyBatch(batch NodeBatch) error
 }
 
-// FileStorage implements NodeStorage using JSON file
+// NodeBatch is a set of changes NodeStorage.ApplyBatch applies at once or not
+// at all. Names and URLs only have to be unique once every change is made.
+type NodeBatch struct {
+	Update []Node // replace the stored nodes with the same ID
+	Add    []Node // get an ID unless they have one
+}
+
+// FileStorage implements NodeStorage using JSON file. Writes are serialized
+// and replace the file atomically, keeping the previous version as a backup.
 type FileStorage struct {
 	filePath string
+	mu       sync.RWMutex
 }
 
 // NewFileStorage creates a new file-based storage
@@ -58,6 +111,13 @@ func NewFileStorage(filePath string) *FileStorage {
 }
 
 func (fs *FileStorage) GetNodes() ([]Node, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.readNodes()
+}
+
+// readNodes reads the node list, the caller must hold fs.mu
+func (fs *FileStorage) readNodes() ([]Node, error) {
 	if _, err := os.Stat(fs.filePath); os.IsNotExist(err) {
 		return []Node{}, nil
 	}
@@ -69,7 +129,12 @@ func (fs *FileStorage) GetNodes() ([]Node, error) {
 
 	var nodes []Node
 	if err := json.Unmarshal(data, &nodes); err != nil {
-		return nil, err
+		// Fall back to the previous version if the file was damaged outside of FileStorage
+		backup, backupErr := os.ReadFile(fs.filePath + ".bak")
+		if backupErr != nil || json.Unmarshal(backup, &nodes) != nil {
+			return nil, err
+		}
+		log.Default().Printf("WARN: %s is corrupted, using %s.bak", fs.filePath, fs.filePath)
 	}
 
 	return nodes, nil
@@ -86,8 +151,21 @@ func generateUniqueID() string {
 	return fmt.Sprintf("node_%s", hex.EncodeToString(bytes))
 }
 
+// duplicateError reports that another node uses the value of field. Deleted
+// nodes keep their name and URL so they can be restored, the error tells how
+// to free them.
+func duplicateError(field string, value string, deleted bool) error {
+	if deleted {
+		return fmt.Errorf("node with %s '%s' already exists in the recycle bin, restore it or delete it with purge=true first", field, value)
+	}
+	return fmt.Errorf("node with %s '%s' already exists", field, value)
+}
+
 func (fs *FileStorage) AddNode(node Node) error {
-	nodes, err := fs.GetNodes()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nodes, err := fs.readNodes()
 	if err != nil {
 		return err
 	}
@@ -95,10 +173,10 @@ func (fs *FileStorage) AddNode(node Node) error {
 	// Check for duplicate name or URL
 	for _, n := range nodes {
 		if n.Name == node.Name {
-			return fmt.Errorf("node with name '%s' already exists", node.Name)
+			return duplicateError("name", node.Name, n.DeletedAt != nil)
 		}
 		if n.URL == node.URL {
-			return fmt.Errorf("node with URL '%s' already exists", node.URL)
+			return duplicateError("URL", node.URL, n.DeletedAt != nil)
 		}
 	}
 
@@ -126,7 +204,10 @@ func (fs *FileStorage) AddNode(node Node) error {
 }
 
 func (fs *FileStorage) UpdateNode(id string, node Node) error {
-	nodes, err := fs.GetNodes()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nodes, err := fs.readNodes()
 	if err != nil {
 		return err
 	}
@@ -135,10 +216,10 @@ func (fs *FileStorage) UpdateNode(id string, node Node) error {
 	for _, n := range nodes {
 		if n.ID != id {
 			if n.Name == node.Name {
-				return fmt.Errorf("node with name '%s' already exists", node.Name)
+				return duplicateError("name", node.Name, n.DeletedAt != nil)
 			}
 			if n.URL == node.URL {
-				return fmt.Errorf("node with URL '%s' already exists", node.URL)
+				return duplicateError("URL", node.URL, n.DeletedAt != nil)
 			}
 		}
 	}
@@ -155,7 +236,10 @@ func (fs *FileStorage) UpdateNode(id string, node Node) error {
 }
 
 func (fs *FileStorage) DeleteNode(id string) error {
-	nodes, err := fs.GetNodes()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nodes, err := fs.readNodes()
 	if err != nil {
 		return err
 	}
@@ -185,21 +269,117 @@ func (fs *FileStorage) GetNode(id string) (*Node, error) {
 	return nil, fmt.Errorf("node not found")
 }
 
+// saveNodes replaces the node list atomically: the new list is written and
+// synced to a temporary file which is then renamed over the old one, after the
+// old one has been copied to a backup. The caller must hold fs.mu.
 func (fs *FileStorage) saveNodes(nodes []Node) error {
 	data, err := json.MarshalIndent(nodes, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(fs.filePath, data, 0644)
+	if current, err := os.ReadFile(fs.filePath); err == nil {
+		if err := writeFileAtomic(fs.filePath+".bak", current, 0644); err != nil {
+			return fmt.Errorf("failed to back up nodes: %w", err)
+		}
+	}
+
+	return writeFileAtomic(fs.filePath, data, 0644)
+}
+
+// ApplyBatch makes every change of batch with a single write of the file
+func (fs *FileStorage) ApplyBatch(batch NodeBatch) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nodes, err := fs.readNodes()
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]int, len(nodes))
+	for i, n := range nodes {
+		index[n.ID] = i
+	}
+	for _, node := range batch.Update {
+		i, ok := index[node.ID]
+		if !ok {
+			return fmt.Errorf("node not found")
+		}
+		nodes[i] = node
+	}
+	for _, node := range batch.Add {
+		for node.ID == "" || hasID(nodes, node.ID) {
+			node.ID = generateUniqueID()
+		}
+		nodes = append(nodes, node)
+	}
+
+	byName := make(map[string]bool, len(nodes))
+	byURL := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		if byName[n.Name] {
+			return duplicateError("name", n.Name, false)
+		}
+		if byURL[n.URL] {
+			return duplicateError("URL", n.URL, false)
+		}
+		byName[n.Name], byURL[n.URL] = true, true
+	}
+
+	return fs.saveNodes(nodes)
+}
+
+func hasID(nodes []Node, id string) bool {
+	for _, n := range nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and
+// renames it to path, so readers see either the old or the new content
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
 }
 
 var storage NodeStorage
 
-// Initialize storage
-func init() {
-	// Use file storage for now, can be extended to database later
-	dataDir := os.Getenv("DATA_DIR")
+// Init sets up node storage, must be called after the config is loaded
+func Init() {
+	dataDir := config.Get().DataDir
 	if dataDir == "" {
 		dataDir = "./data"
 	}
@@ -207,11 +387,32 @@ func init() {
 	// Ensure data directory exists
 	os.MkdirAll(dataDir, 0755)
 	
-	storage = NewFileStorage(dataDir + "/nodes.json")
+	switch config.Get().NodeStorage {
+	case "sqlite":
+		sqliteStorage, err := NewSQLiteStorage(dataDir + "/nodes.db")
+		if err != nil {
+			log.Fatalf("Failed to open node database: %v", err)
+		}
+		storage = sqliteStorage
+		tokenStorage = sqliteStorage
+
+		// Import the node list of the file storage on first use
+		if _, err := os.Stat(dataDir + "/nodes.json"); err == nil && !hasApiNodes() {
+			imported, err := sqliteStorage.ImportFromFile(dataDir + "/nodes.json")
+			if err != nil {
+				log.Default().Printf("WARN: Failed to import nodes.json: %v", err)
+			} else {
+				log.Default().Printf("Imported %d nodes from nodes.json", imported)
+			}
+		}
+	default:
+		storage = NewFileStorage(dataDir + "/nodes.json")
+		tokenStorage = NewFileTokenStorage(dataDir + "/tokens.json")
+	}
 	
-	// Auto-migrate from environment variables if API key is set but no API nodes exist
-	if os.Getenv("ADMIN_API_KEY") != "" && !hasApiNodes() {
-		envNodes := getEnvironmentNodes()
+	// Auto-migrate from configured nodes if API key is set but no API nodes exist
+	if config.Get().AdminApiKey != "" && !hasApiNodes() {
+		envNodes := getConfiguredNodes()
 		if len(envNodes) > 0 {
 			fmt.Printf("Auto-migrating %d nodes from environment variables to API management...\n", len(envNodes))
 			migratedCount := 0
@@ -227,15 +428,11 @@ func init() {
 	}
 }
 
-// RequireApiKey is the exported auth middleware for admin operations
+// RequireApiKey is the exported auth middleware for admin operations. It
+// accepts ADMIN_API_KEY or an API token and records the granted scopes,
+// which RequireScope checks.
 func RequireApiKey(c *gin.Context) {
-	apiKey := c.GetHeader("X-Api-Key")
-	if apiKey == "" {
-		apiKey = c.Query("api_key")
-	}
-
-	expectedKey := os.Getenv("ADMIN_API_KEY")
-	if expectedKey == "" {
+	if config.Get().AdminApiKey == "" {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
 			"error":   "Admin API key not configured",
@@ -244,7 +441,8 @@ func RequireApiKey(c *gin.Context) {
 		return
 	}
 
-	if apiKey != expectedKey {
+	tokenID, scopes := authenticate(requestApiKey(c))
+	if scopes == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"success": false,
 			"error":   "Invalid API key",
@@ -253,31 +451,42 @@ func RequireApiKey(c *gin.Context) {
 		return
 	}
 
+	c.Set("apiTokenID", tokenID)
+	c.Set("apiScopes", scopes)
 	c.Next()
 }
 
 // GetNodes returns the list of LG nodes with backward compatibility
 func GetNodes(c *gin.Context) {
-	var nodes []Node
-	
-	// If ADMIN_API_KEY is set, use API-managed nodes
-	if os.Getenv("ADMIN_API_KEY") != "" {
-		if apiNodes, err := storage.GetNodes(); err == nil && len(apiNodes) > 0 {
-			nodes = apiNodes
-		}
-	} else {
-		// If no ADMIN_API_KEY, use environment variables (legacy mode)
-		nodes = getEnvironmentNodes()
+	filter, err := filterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
 	}
-	
-	// Mark current node
-	currentNodeURL := os.Getenv("LG_CURRENT_URL")
-	for i, node := range nodes {
+
+	nodes := []Node{}
+	currentNodeURL := config.Get().CurrentNodeURL
+	for _, node := range visibleNodes() {
+		if !filter.match(node) {
+			continue
+		}
+		// Mark current node
 		if node.URL == currentNodeURL {
-			nodes[i].Current = true
+			node.Current = true
+		}
+		node.Federated = config.Get().FeatureFederation && (node.ApiKey != "" || node.IsAgent()) && node.Active() && !node.Current
+		if node.Enrolled {
+			lastHeartbeat := getHeartbeat(node.ID)
+			node.LastHeartbeat = &lastHeartbeat
+			node.Stale = isStale(lastHeartbeat)
 		}
 		// Remove API key from response
-		nodes[i].ApiKey = ""
+		node.ApiKey = ""
+		node.Health = getHealth(node.URL)
+		nodes = append(nodes, node)
 	}
 	
 	c.JSON(200, gin.H{
@@ -286,28 +495,171 @@ func GetNodes(c *gin.Context) {
 	})
 }
 
-// Helper function to get nodes from environment variables
-func getEnvironmentNodes() []Node {
+// listNodes returns the API-managed nodes that are not deleted if
+// ADMIN_API_KEY is set, otherwise the configured nodes
+func listNodes() []Node {
 	var nodes []Node
-	nodesEnv := os.Getenv("LG_NODES")
-	if nodesEnv != "" {
-		nodeStrings := strings.Split(nodesEnv, ";")
-		
-		for _, nodeStr := range nodeStrings {
-			parts := strings.Split(nodeStr, "|")
-			if len(parts) >= 3 {
-				node := Node{
-					Name:     parts[0],
-					Location: parts[1],
-					URL:      parts[2],
-				}
-				nodes = append(nodes, node)
-			}
+	
+	// If ADMIN_API_KEY is set, use API-managed nodes
+	if config.Get().AdminApiKey != "" {
+		if apiNodes, err := storage.GetNodes(); err == nil && len(apiNodes) > 0 {
+			nodes = sortNodes(withoutDeleted(apiNodes))
 		}
+	} else {
+		// If no ADMIN_API_KEY, use configured nodes (legacy mode)
+		nodes = getConfiguredNodes()
 	}
 	return nodes
 }
 
+// visibleNodes returns the nodes of listNodes that are not disabled, the
+// ones public endpoints may show
+func visibleNodes() []Node {
+	var nodes []Node
+	for _, node := range listNodes() {
+		if node.State != StateDisabled {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Helper function to get nodes from the config file or LG_NODES
+func getConfiguredNodes() []Node {
+	var nodes []Node
+	for _, n := range config.Get().Nodes {
+		nodes = append(nodes, Node{
+			Name:         n.Name,
+			Location:     n.Location,
+			URL:          n.URL,
+			NodeMetadata: n.NodeMetadata,
+		})
+	}
+	return nodes
+}
+
+// Lookup returns the API-managed node with the given ID, deleted nodes are
+// not found
+func Lookup(id string) (*Node, error) {
+	node, err := storage.GetNode(id)
+	if err == nil && node.DeletedAt != nil {
+		return nil, fmt.Errorf("node not found")
+	}
+	return node, err
+}
+
+// withoutDeleted drops the soft-deleted nodes
+func withoutDeleted(all []Node) []Node {
+	nodes := []Node{}
+	for _, n := range all {
+		if n.DeletedAt == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// sortNodes orders nodes by weight, nodes of equal weight keep their order
+func sortNodes(nodes []Node) []Node {
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Weight < nodes[j].Weight })
+	return nodes
+}
+
+// RegisterAgent adds the node of a reverse-connected agent, or refreshes its
+// location and advertised capabilities if it is already registered. The node
+// belongs to the token that registered it first, other tokens may only take
+// it over once that token is deleted. Deleted nodes stay deleted until an
+// admin restores them.
+func RegisterAgent(tokenID string, name string, location string, metadata config.NodeMetadata) (*Node, error) {
+	if err := normalizeMetadata(&metadata); err != nil {
+		return nil, err
+	}
+
+	url := AgentURLPrefix + name
+	node, err := findByURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		err = storage.AddNode(Node{
+			Name:         name,
+			Location:     location,
+			URL:          url,
+			NodeMetadata: metadata,
+			OwnerTokenID: tokenID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return findByURL(url)
+	}
+
+	if node.DeletedAt != nil {
+		return nil, fmt.Errorf("node %s was deleted, an admin must restore it before the agent can register again", name)
+	}
+	if other, err := ownedByOther(node, tokenID); err != nil {
+		return nil, err
+	} else if other {
+		return nil, fmt.Errorf("agent name %s is registered with another token", name)
+	}
+
+	// Keep what the admin set, only refresh what the agent knows best
+	node.OwnerTokenID = tokenID
+	node.Location = location
+	node.Features = metadata.Features
+	node.IPv4 = metadata.IPv4
+	node.IPv6 = metadata.IPv6
+	if err := storage.UpdateNode(node.ID, *node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// findByURL returns the API-managed node with the given URL, nil if there is none
+func findByURL(url string) (*Node, error) {
+	all, err := storage.GetNodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range all {
+		if n.URL == url {
+			return &n, nil
+		}
+	}
+	return nil, nil
+}
+
+// Select returns the active API-managed nodes matching the filter query
+// parameters of GET /nodes, limited to the comma separated IDs of the nodes
+// parameter if it is given
+func Select(c *gin.Context) ([]Node, error) {
+	filter, err := filterFromQuery(c)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := storage.GetNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if v := c.Query("nodes"); v != "" {
+		ids = strings.Split(v, ",")
+	}
+
+	var selected []Node
+	for _, node := range sortNodes(all) {
+		if !node.Active() || len(ids) > 0 && !contains(ids, node.ID) {
+			continue
+		}
+		if filter.match(node) {
+			selected = append(selected, node)
+		}
+	}
+	return selected, nil
+}
+
 // Helper function to check if API nodes exist
 func hasApiNodes() bool {
 	apiNodes, err := storage.GetNodes()
@@ -335,6 +687,28 @@ func CreateNode(c *gin.Context) {
 			})
 			return
 		}
+
+		metadata, err := metadataFromQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		req.NodeMetadata = metadata
+
+		req.State = c.Query("state")
+		req.StateMessage = c.Query("state_message")
+		if v := c.Query("weight"); v != "" {
+			if req.Weight, err = strconv.Atoi(v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"success": false,
+					"error":   "weight must be an integer",
+				})
+				return
+			}
+		}
 	} else {
 		// POST request with JSON body
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -346,10 +720,32 @@ func CreateNode(c *gin.Context) {
 		}
 	}
 
+	if err := normalizeMetadata(&req.NodeMetadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	state, stateMessage, err := normalizeState(req.State, req.StateMessage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
 	node := Node{
-		Name:     req.Name,
-		Location: req.Location,
-		URL:      req.URL,
+		Name:         req.Name,
+		Location:     req.Location,
+		URL:          req.URL,
+		ApiKey:       req.ApiKey,
+		NodeMetadata: req.NodeMetadata,
+		Weight:       req.Weight,
+		State:        state,
+		StateMessage: stateMessage,
 	}
 
 	if err := storage.AddNode(node); err != nil {
@@ -387,10 +783,42 @@ func UpdateNode(c *gin.Context) {
 		return
 	}
 
+	if err := normalizeMetadata(&req.NodeMetadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	state, stateMessage, err := normalizeState(req.State, req.StateMessage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
 	node := Node{
-		Name:     req.Name,
-		Location: req.Location,
-		URL:      req.URL,
+		Name:         req.Name,
+		Location:     req.Location,
+		URL:          req.URL,
+		ApiKey:       req.ApiKey,
+		NodeMetadata: req.NodeMetadata,
+		Weight:       req.Weight,
+		State:        state,
+		StateMessage: stateMessage,
+	}
+
+	// The API key is never returned, keep it unless a new one is sent
+	if existing, err := storage.GetNode(id); err == nil {
+		if node.ApiKey == "" {
+			node.ApiKey = existing.ApiKey
+		}
+		node.Enrolled = existing.Enrolled
+		node.OwnerTokenID = existing.OwnerTokenID
+		node.DeletedAt = existing.DeletedAt
 	}
 
 	if err := storage.UpdateNode(id, node); err != nil {
@@ -419,11 +847,18 @@ func UpdateNode(c *gin.Context) {
 	})
 }
 
-// DeleteNode deletes a node (admin only)
+// DeleteNode moves a node to the trash, from where it can be restored, or
+// deletes it for good with purge=true (admin only)
 func DeleteNode(c *gin.Context) {
 	id := c.Param("id")
 
-	if err := storage.DeleteNode(id); err != nil {
+	var err error
+	if purge, _ := strconv.ParseBool(c.Query("purge")); purge {
+		err = storage.DeleteNode(id)
+	} else {
+		err = softDeleteNode(id)
+	}
+	if err != nil {
 		if err.Error() == "node not found" {
 			c.JSON(http.StatusNotFound, gin.H{
 				"success": false,
@@ -517,10 +952,10 @@ func TestLatency(c *gin.Context) {
 
 // GetNodeConfig returns the current node configuration
 func GetNodeConfig(c *gin.Context) {
-	// Get current node info from environment
-	currentName := os.Getenv("LG_CURRENT_NAME")
-	currentLocation := os.Getenv("LG_CURRENT_LOCATION")
-	currentURL := os.Getenv("LG_CURRENT_URL")
+	// Get current node info from config
+	currentName := config.Get().CurrentNodeName
+	currentLocation := config.Get().CurrentNodeLocation
+	currentURL := config.Get().CurrentNodeURL
 	
 	if currentName == "" {
 		currentName = "Local"
@@ -0,0 +1,438 @@
+package nodes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order, the index + 1 is the schema version
+var migrations = []string{
+	`CREATE TABLE nodes (
+		seq      INTEGER PRIMARY KEY AUTOINCREMENT,
+		id       TEXT NOT NULL UNIQUE,
+		name     TEXT NOT NULL UNIQUE,
+		location TEXT NOT NULL,
+		url      TEXT NOT NULL UNIQUE,
+		api_key  TEXT NOT NULL DEFAULT ''
+	)`,
+	`ALTER TABLE nodes ADD COLUMN country_code TEXT NOT NULL DEFAULT '';
+	ALTER TABLE nodes ADD COLUMN region TEXT NOT NULL DEFAULT '';
+	ALTER TABLE nodes ADD COLUMN provider TEXT NOT NULL DEFAULT '';
+	ALTER TABLE nodes ADD COLUMN asn TEXT NOT NULL DEFAULT '';
+	ALTER TABLE nodes ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE nodes ADD COLUMN ipv4 INTEGER;
+	ALTER TABLE nodes ADD COLUMN ipv6 INTEGER;
+	ALTER TABLE nodes ADD COLUMN features TEXT NOT NULL DEFAULT '[]'`,
+	`CREATE TABLE tokens (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL UNIQUE,
+		hash       TEXT NOT NULL UNIQUE,
+		scopes     TEXT NOT NULL DEFAULT '[]',
+		created_at INTEGER NOT NULL,
+		last_used  INTEGER
+	)`,
+	`ALTER TABLE nodes ADD COLUMN enrolled INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE nodes ADD COLUMN weight INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE nodes ADD COLUMN state TEXT NOT NULL DEFAULT '';
+	ALTER TABLE nodes ADD COLUMN state_message TEXT NOT NULL DEFAULT '';
+	ALTER TABLE nodes ADD COLUMN deleted_at INTEGER`,
+	`ALTER TABLE nodes ADD COLUMN agent_token_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE nodes RENAME COLUMN agent_token_id TO owner_token_id`,
+}
+
+const nodeColumns = `id, name, location, url, api_key, country_code, region, provider, asn, tags, ipv4, ipv6, features, enrolled, weight, state, state_message, deleted_at, owner_token_id`
+
+// nodePlaceholders has a placeholder for each of nodeColumns
+var nodePlaceholders = "?" + strings.Repeat(", ?", strings.Count(nodeColumns, ","))
+
+// nodeValues returns the values of node in the order of nodeColumns
+func nodeValues(node Node) []interface{} {
+	tags, _ := json.Marshal(node.Tags)
+	features, _ := json.Marshal(node.Features)
+	var deletedAt sql.NullInt64
+	if node.DeletedAt != nil {
+		deletedAt = sql.NullInt64{Int64: node.DeletedAt.Unix(), Valid: true}
+	}
+	return []interface{}{
+		node.ID, node.Name, node.Location, node.URL, node.ApiKey,
+		node.CountryCode, node.Region, node.Provider, node.ASN, string(tags),
+		node.IPv4, node.IPv6, string(features), node.Enrolled,
+		node.Weight, node.State, node.StateMessage, deletedAt, node.OwnerTokenID,
+	}
+}
+
+// scanNode reads a row selected with nodeColumns
+func scanNode(row interface{ Scan(...interface{}) error }) (Node, error) {
+	var n Node
+	var tags, features string
+	var ipv4, ipv6 sql.NullBool
+	var deletedAt sql.NullInt64
+	err := row.Scan(&n.ID, &n.Name, &n.Location, &n.URL, &n.ApiKey,
+		&n.CountryCode, &n.Region, &n.Provider, &n.ASN, &tags,
+		&ipv4, &ipv6, &features, &n.Enrolled,
+		&n.Weight, &n.State, &n.StateMessage, &deletedAt, &n.OwnerTokenID)
+	if err != nil {
+		return n, err
+	}
+	json.Unmarshal([]byte(tags), &n.Tags)
+	json.Unmarshal([]byte(features), &n.Features)
+	if ipv4.Valid {
+		n.IPv4 = &ipv4.Bool
+	}
+	if ipv6.Valid {
+		n.IPv6 = &ipv6.Bool
+	}
+	if deletedAt.Valid {
+		at := time.Unix(deletedAt.Int64, 0).UTC()
+		n.DeletedAt = &at
+	}
+	return n, nil
+}
+
+// SQLiteStorage implements NodeStorage and TokenStorage using a SQLite database
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// NewSQLiteStorage opens the database at path and migrates it to the latest schema
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer, serialize access instead of retrying on SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteStorage{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteStorage) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	var version int
+	err := s.db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err := s.db.Exec(`INSERT INTO schema_version (version) VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(`UPDATE schema_version SET version = ?`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetNodes() ([]Node, error) {
+	rows, err := s.db.Query(`SELECT ` + nodeColumns + ` FROM nodes ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := []Node{}
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// checkDuplicate returns an error if another node already uses the name or URL
+func checkDuplicate(tx *sql.Tx, id string, node Node) error {
+	var name, url string
+	var deletedAt sql.NullInt64
+	err := tx.QueryRow(`SELECT name, url, deleted_at FROM nodes WHERE id != ? AND (name = ? OR url = ?) LIMIT 1`,
+		id, node.Name, node.URL).Scan(&name, &url, &deletedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if name == node.Name {
+		return duplicateError("name", node.Name, deletedAt.Valid)
+	}
+	return duplicateError("URL", node.URL, deletedAt.Valid)
+}
+
+func (s *SQLiteStorage) AddNode(node Node) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkDuplicate(tx, "", node); err != nil {
+		return err
+	}
+
+	// Generate unique ID if not provided
+	generated := node.ID == ""
+	for {
+		if generated {
+			node.ID = generateUniqueID()
+		}
+		_, err = tx.Exec(`INSERT INTO nodes (`+nodeColumns+`) VALUES (`+nodePlaceholders+`)`,
+			nodeValues(node)...)
+		if err == nil || !generated || !strings.Contains(err.Error(), "nodes.id") {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) UpdateNode(id string, node Node) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkDuplicate(tx, id, node); err != nil {
+		return err
+	}
+
+	node.ID = id
+	result, err := tx.Exec(`UPDATE nodes SET (`+nodeColumns+`) = (`+nodePlaceholders+`) WHERE id = ?`,
+		append(nodeValues(node), id)...)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("node not found")
+	}
+
+	return tx.Commit()
+}
+
+// ApplyBatch makes every change of batch in a single transaction
+func (s *SQLiteStorage) ApplyBatch(batch NodeBatch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Free the names and URLs of the updated nodes first, so they may swap
+	// them without tripping the unique constraints
+	for _, node := range batch.Update {
+		placeholder := "\x00" + node.ID
+		if _, err := tx.Exec(`UPDATE nodes SET name = ?, url = ? WHERE id = ?`, placeholder, placeholder, node.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range batch.Update {
+		if err := checkDuplicate(tx, node.ID, node); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`UPDATE nodes SET (`+nodeColumns+`) = (`+nodePlaceholders+`) WHERE id = ?`,
+			append(nodeValues(node), node.ID)...)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return fmt.Errorf("node not found")
+		}
+	}
+
+	for _, node := range batch.Add {
+		if err := checkDuplicate(tx, "", node); err != nil {
+			return err
+		}
+		generated := node.ID == ""
+		for {
+			if generated {
+				node.ID = generateUniqueID()
+			}
+			_, err = tx.Exec(`INSERT INTO nodes (`+nodeColumns+`) VALUES (`+nodePlaceholders+`)`,
+				nodeValues(node)...)
+			if err == nil || !generated || !strings.Contains(err.Error(), "nodes.id") {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) DeleteNode(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM nodes WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("node not found")
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) GetNode(id string) (*Node, error) {
+	n, err := scanNode(s.db.QueryRow(`SELECT `+nodeColumns+` FROM nodes WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("node not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// ImportFromFile imports the nodes of a FileStorage nodes.json in a single
+// transaction. Nodes clashing with an existing ID, name or URL are skipped.
+func (s *SQLiteStorage) ImportFromFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var nodes []Node
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	for _, node := range nodes {
+		if node.ID == "" {
+			node.ID = generateUniqueID()
+		}
+		result, err := tx.Exec(`INSERT OR IGNORE INTO nodes (`+nodeColumns+`) VALUES (`+nodePlaceholders+`)`,
+			nodeValues(node)...)
+		if err != nil {
+			return 0, err
+		}
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			imported++
+		}
+	}
+
+	return imported, tx.Commit()
+}
+
+const tokenColumns = `id, name, hash, scopes, created_at, last_used`
+
+// scanToken reads a row selected with tokenColumns
+func scanToken(row interface{ Scan(...interface{}) error }) (Token, error) {
+	var t Token
+	var scopes string
+	var createdAt int64
+	var lastUsed sql.NullInt64
+	if err := row.Scan(&t.ID, &t.Name, &t.Hash, &scopes, &createdAt, &lastUsed); err != nil {
+		return t, err
+	}
+	json.Unmarshal([]byte(scopes), &t.Scopes)
+	t.CreatedAt = time.Unix(createdAt, 0).UTC()
+	if lastUsed.Valid {
+		at := time.Unix(lastUsed.Int64, 0).UTC()
+		t.LastUsed = &at
+	}
+	return t, nil
+}
+
+func (s *SQLiteStorage) GetTokens() ([]Token, error) {
+	rows, err := s.db.Query(`SELECT ` + tokenColumns + ` FROM tokens ORDER BY created_at, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQLiteStorage) AddToken(token Token) error {
+	scopes, _ := json.Marshal(token.Scopes)
+	_, err := s.db.Exec(`INSERT INTO tokens (`+tokenColumns+`) VALUES (?, ?, ?, ?, ?, NULL)`,
+		token.ID, token.Name, token.Hash, string(scopes), token.CreatedAt.Unix())
+	if err != nil && strings.Contains(err.Error(), "tokens.name") {
+		return fmt.Errorf("token with name '%s' already exists", token.Name)
+	}
+	return err
+}
+
+func (s *SQLiteStorage) DeleteToken(id string) error {
+	result, err := s.db.Exec(`DELETE FROM tokens WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("token not found")
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetTokenByHash(hash string) (*Token, error) {
+	t, err := scanToken(s.db.QueryRow(`SELECT `+tokenColumns+` FROM tokens WHERE hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *SQLiteStorage) TouchToken(id string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE tokens SET last_used = ? WHERE id = ?`, at.Unix(), id)
+	return err
+}
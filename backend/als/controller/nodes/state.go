@@ -0,0 +1,153 @@
+package nodes
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StateRequest represents the request payload for changing the state of a node
+type StateRequest struct {
+	State   string `json:"state" binding:"required"`
+	Message string `json:"message"`
+}
+
+// normalizeState checks a node state, the enabled state is stored empty and
+// carries no message
+func normalizeState(state string, message string) (string, string, error) {
+	state = strings.ToLower(strings.TrimSpace(state))
+	switch state {
+	case "", StateEnabled:
+		return "", "", nil
+	case StateDisabled, StateMaintenance:
+		return state, strings.TrimSpace(message), nil
+	default:
+		return "", "", fmt.Errorf("unknown state '%s', expected %s, %s or %s", state, StateEnabled, StateDisabled, StateMaintenance)
+	}
+}
+
+// softDeleteNode marks a node as deleted, keeping its ID, name and URL
+func softDeleteNode(id string) error {
+	node, err := storage.GetNode(id)
+	if err != nil {
+		return err
+	}
+	if node.DeletedAt != nil {
+		return fmt.Errorf("node not found")
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	node.DeletedAt = &now
+	return storage.UpdateNode(id, *node)
+}
+
+// SetNodeState enables or disables a node, or puts it under maintenance
+// with an optional message (admin only)
+func SetNodeState(c *gin.Context) {
+	var req StateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	state, message, err := normalizeState(req.State, req.Message)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	node, err := Lookup(c.Param("id"))
+	if err == nil {
+		node.State = state
+		node.StateMessage = message
+		err = storage.UpdateNode(node.ID, *node)
+	}
+	if err != nil {
+		if err.Error() == "node not found" {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "Node not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Node state updated successfully",
+	})
+}
+
+// GetDeletedNodes lists the nodes in the trash (admin only)
+func GetDeletedNodes(c *gin.Context) {
+	all, err := storage.GetNodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	deleted := []Node{}
+	for _, node := range all {
+		if node.DeletedAt != nil {
+			node.ApiKey = ""
+			deleted = append(deleted, node)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"nodes":   deleted,
+	})
+}
+
+// RestoreNode takes a node out of the trash with its previous ID and
+// settings (admin only)
+func RestoreNode(c *gin.Context) {
+	node, err := storage.GetNode(c.Param("id"))
+	if err == nil && node.DeletedAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "Node is not deleted",
+		})
+		return
+	}
+	if err == nil {
+		node.DeletedAt = nil
+		err = storage.UpdateNode(node.ID, *node)
+	}
+	if err != nil {
+		if err.Error() == "node not found" {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "Node not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Node restored successfully",
+	})
+}
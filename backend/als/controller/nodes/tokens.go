@@ -0,0 +1,429 @@
+package nodes
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Token scopes. Each must be granted explicitly, read included.
+const (
+	ScopeRead        = "read"
+	ScopeNodesWrite  = "nodes:write"
+	ScopeConfigWrite = "config:write"
+	ScopeQueueWrite  = "queue:write"
+	ScopeFederation  = "federation" // lets another node run tools on this one
+	ScopeAgent       = "agent"      // lets an agent connect and register itself
+	ScopeEnroll      = "enroll"     // lets a node register itself and send heartbeats
+
+	// scopeMaster is only held by ADMIN_API_KEY, which can also manage tokens
+	scopeMaster = "*"
+)
+
+// masterKeyID identifies ADMIN_API_KEY where a token ID is expected
+const masterKeyID = "admin"
+
+var knownScopes = []string{ScopeRead, ScopeNodesWrite, ScopeConfigWrite, ScopeQueueWrite, ScopeFederation, ScopeAgent, ScopeEnroll}
+
+// lastUsedPrecision limits how often the last use of a token is written back
+const lastUsedPrecision = time.Minute
+
+// Token is a named admin API token. Only the SHA-256 hash of the secret is stored.
+type Token struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+// TokenRequest represents the request payload for token creation
+type TokenRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	Scopes []string `json:"scopes" binding:"required"`
+}
+
+// TokenStorage interface for different storage backends
+type TokenStorage interface {
+	GetTokens() ([]Token, error)
+	AddToken(token Token) error
+	DeleteToken(id string) error
+	GetTokenByHash(hash string) (*Token, error)
+	TouchToken(id string, at time.Time) error
+}
+
+// FileTokenStorage implements TokenStorage using a JSON file
+type FileTokenStorage struct {
+	filePath string
+	mu       sync.RWMutex
+}
+
+// NewFileTokenStorage creates a new file-based token storage
+func NewFileTokenStorage(filePath string) *FileTokenStorage {
+	return &FileTokenStorage{filePath: filePath}
+}
+
+func (fs *FileTokenStorage) GetTokens() ([]Token, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.readTokens()
+}
+
+// readTokens reads the token list, the caller must hold fs.mu
+func (fs *FileTokenStorage) readTokens() ([]Token, error) {
+	data, err := os.ReadFile(fs.filePath)
+	if os.IsNotExist(err) {
+		return []Token{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// saveTokens replaces the token list atomically, the caller must hold fs.mu
+func (fs *FileTokenStorage) saveTokens(tokens []Token) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs.filePath, data, 0600)
+}
+
+func (fs *FileTokenStorage) AddToken(token Token) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	tokens, err := fs.readTokens()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		if t.Name == token.Name {
+			return fmt.Errorf("token with name '%s' already exists", token.Name)
+		}
+	}
+
+	return fs.saveTokens(append(tokens, token))
+}
+
+func (fs *FileTokenStorage) DeleteToken(id string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	tokens, err := fs.readTokens()
+	if err != nil {
+		return err
+	}
+
+	for i, t := range tokens {
+		if t.ID == id {
+			return fs.saveTokens(append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+
+	return fmt.Errorf("token not found")
+}
+
+func (fs *FileTokenStorage) GetTokenByHash(hash string) (*Token, error) {
+	tokens, err := fs.GetTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return &t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("token not found")
+}
+
+func (fs *FileTokenStorage) TouchToken(id string, at time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	tokens, err := fs.readTokens()
+	if err != nil {
+		return err
+	}
+
+	for i, t := range tokens {
+		if t.ID == id {
+			tokens[i].LastUsed = &at
+			return fs.saveTokens(tokens)
+		}
+	}
+
+	return fmt.Errorf("token not found")
+}
+
+var tokenStorage TokenStorage
+
+// hashToken returns the hex encoded SHA-256 of a token secret. Secrets are
+// random, so a slow password hash is not needed.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateToken returns a new token ID and secret
+func generateToken() (id string, secret string, err error) {
+	idBytes := make([]byte, 4)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", err
+	}
+	return "tok_" + hex.EncodeToString(idBytes), "als_" + hex.EncodeToString(secretBytes), nil
+}
+
+// requestApiKey returns the API key sent in the X-Api-Key header or an
+// Authorization bearer token. The api_key query parameter, which ends up in
+// access logs, is only still accepted for ADMIN_API_KEY and is deprecated.
+func requestApiKey(c *gin.Context) string {
+	if apiKey := c.GetHeader("X-Api-Key"); apiKey != "" {
+		return apiKey
+	}
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	apiKey := c.Query("api_key")
+	if masterKey := config.Get().AdminApiKey; apiKey == "" || masterKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(masterKey)) != 1 {
+		return ""
+	}
+	log.Default().Printf("WARN: ADMIN_API_KEY passed in the api_key query parameter of %s, which is deprecated, send the X-Api-Key header instead", c.FullPath())
+	return apiKey
+}
+
+// authenticate returns the ID of the token apiKey belongs to and the scopes
+// it grants, nil scopes if it is not valid
+func authenticate(apiKey string) (string, []string) {
+	if apiKey == "" {
+		return "", nil
+	}
+	if masterKey := config.Get().AdminApiKey; masterKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(masterKey)) == 1 {
+		return masterKeyID, []string{scopeMaster}
+	}
+
+	token, err := tokenStorage.GetTokenByHash(hashToken(apiKey))
+	if err != nil {
+		return "", nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) >= lastUsedPrecision {
+		tokenStorage.TouchToken(token.ID, now)
+	}
+	return token.ID, token.Scopes
+}
+
+// TokenID returns the ID of the token the request was authenticated with,
+// "admin" for ADMIN_API_KEY. It must run after RequireApiKey.
+func TokenID(c *gin.Context) string {
+	return c.GetString("apiTokenID")
+}
+
+// ownedByOther reports whether node was registered with a token other than
+// tokenID. Nodes of a deleted token may be taken over.
+func ownedByOther(node *Node, tokenID string) (bool, error) {
+	if node.OwnerTokenID == "" || node.OwnerTokenID == tokenID {
+		return false, nil
+	}
+	exists, err := tokenExists(node.OwnerTokenID)
+	return exists, err
+}
+
+// tokenExists reports whether the token with the given ID still exists
+func tokenExists(id string) (bool, error) {
+	if id == masterKeyID {
+		return true, nil
+	}
+	tokens, err := tokenStorage.GetTokens()
+	if err != nil {
+		return false, err
+	}
+	for _, t := range tokens {
+		if t.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hasScope reports whether scopes grant scope
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scopeMaster || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope rejects requests whose API key does not grant scope, it must
+// be used after RequireApiKey
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasScope(c.GetStringSlice("apiScopes"), scope) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"error":   fmt.Sprintf("API key lacks the %s scope", scope),
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireMasterKey only lets ADMIN_API_KEY through, it must be used after
+// RequireApiKey
+func RequireMasterKey(c *gin.Context) {
+	if !contains(c.GetStringSlice("apiScopes"), scopeMaster) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "Only the admin API key can manage tokens",
+		})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// GetTokens lists the API tokens without their hashes (master key only)
+func GetTokens(c *gin.Context) {
+	tokens, err := tokenStorage.GetTokens()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"tokens":  tokens,
+	})
+}
+
+// CreateToken creates a new API token and returns its secret, which cannot
+// be retrieved again (master key only)
+func CreateToken(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	scopes := normalizeList(req.Scopes)
+	if len(scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "At least one scope is required",
+		})
+		return
+	}
+	for _, scope := range scopes {
+		if !contains(knownScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   fmt.Sprintf("unknown scope %q, expected one of %s", scope, strings.Join(knownScopes, ", ")),
+			})
+			return
+		}
+	}
+
+	id, secret, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	token := Token{
+		ID:        id,
+		Name:      req.Name,
+		Scopes:    scopes,
+		Hash:      hashToken(secret),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	if err := tokenStorage.AddToken(token); err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	token.Hash = ""
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"token":   token,
+		"secret":  secret,
+	})
+}
+
+// DeleteToken revokes an API token (master key only)
+func DeleteToken(c *gin.Context) {
+	if err := tokenStorage.DeleteToken(c.Param("id")); err != nil {
+		if err.Error() == "token not found" {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "Token not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Token revoked successfully",
+	})
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/target"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// ToolParams are the effective tunables of a single tool run
+type ToolParams struct {
+	Count      int
+	Interval   time.Duration
+	PacketSize int
+	MaxHops    int
+	Timeout    time.Duration
+}
+
+// ParseToolParams reads the count, interval (in milliseconds), packet_size and
+// max_hops query parameters on top of the operator defaults of tool. Values
+// outside the operator bounds are rejected.
+func ParseToolParams(c *gin.Context, tool config.ToolConfig) (*ToolParams, error) {
+	count, err := queryInt(c, "count", tool.Count, 1, tool.MaxCount)
+	if err != nil {
+		return nil, err
+	}
+
+	// The interval is only adjustable within the bounds of the operator
+	interval, err := queryInt(c, "interval", tool.Interval, tool.MinInterval, tool.MaxInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	packetSize, err := queryInt(c, "packet_size", tool.PacketSize, 0, tool.MaxPacketSize)
+	if err != nil {
+		return nil, err
+	}
+
+	maxHops, err := queryInt(c, "max_hops", tool.MaxHops, 1, tool.MaxHopsLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &ToolParams{
+		Count:      count,
+		Interval:   time.Duration(interval) * time.Millisecond,
+		PacketSize: packetSize,
+		MaxHops:    maxHops,
+	}
+
+	timeout := tool.TimeoutSeconds(config.Get().ToolTimeout)
+	params.Timeout = time.Duration(timeout) * time.Second
+
+	// A run must fit in the timeout, which is never extended
+	if config.RunDuration(count, interval) > params.Timeout {
+		return nil, fmt.Errorf("count × interval must fit in the %d second timeout of this tool", timeout)
+	}
+
+	return params, nil
+}
+
+// ParsePort reads the port query parameter, def if it is absent
+func ParsePort(c *gin.Context, def int) (int, error) {
+	return queryInt(c, "port", def, 1, 65535)
+}
+
+// queryInt returns the integer query parameter name, or def if it is absent.
+// A max of 0 means the parameter cannot be overridden.
+func queryInt(c *gin.Context, name string, def int, min int, max int) (int, error) {
+	v, ok := c.GetQuery(name)
+	if !ok || v == "" {
+		return def, nil
+	}
+
+	if max == 0 {
+		return 0, fmt.Errorf("%s cannot be changed on this node", name)
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", name)
+	}
+
+	if i < min || i > max {
+		return 0, fmt.Errorf("%s must be between %d and %d", name, min, max)
+	}
+
+	return i, nil
+}
+
+// ResolveTarget resolves host to the address of family that tool runs
+// against and announces it to the session in a Resolved event. If the
+// target cannot be resolved or the target policy refuses it, it answers the
+// request and returns false.
+func ResolveTarget(c *gin.Context, tool string, host string, family string) (string, bool) {
+	resolution, err := target.Resolve(c.Request.Context(), host, family)
+	if err != nil {
+		status := 400
+		if _, blocked := err.(*target.BlockedError); blocked {
+			status = 403
+		}
+		c.JSON(status, &gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return "", false
+	}
+
+	if v, ok := c.Get("clientSession"); ok {
+		content, _ := json.Marshal(struct {
+			Tool string `json:"tool"`
+			*target.Resolution
+		}{tool, resolution})
+		select {
+		case v.(*client.ClientSession).Channel <- &client.Message{
+			Name:    "Resolved",
+			Content: string(content),
+		}:
+		case <-c.Request.Context().Done():
+		}
+	}
+	return resolution.Address, true
+}
@@ -0,0 +1,166 @@
+package ping
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/als/target"
+	"github.com/gin-gonic/gin"
+)
+
+// HandleHTTPing requests a URL, https://<ip>/ when only a host is given, on a
+// new connection per attempt and reports the time taken by each phase.
+// Redirects are not followed.
+func HandleHTTPing(c *gin.Context) {
+	u, err := parseHTTPTarget(c.Query("ip"))
+	if err != nil {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	family := c.DefaultQuery("family", target.FamilyIPv4)
+
+	handleProbe(c, "httping", "HTTPing", host, func(ctx context.Context, _ string, seq int) *ProbeEvent {
+		event := &ProbeEvent{Seq: seq}
+		event.Port, _ = strconv.Atoi(port)
+		start := time.Now()
+
+		// Resolved again on every attempt to time the lookup, the policy
+		// is applied to whatever address comes back
+		resolution, err := target.Resolve(ctx, host, family)
+		event.DNS = time.Since(start)
+		if err != nil {
+			fail(event, err)
+			return event
+		}
+		event.From = resolution.Address
+
+		if err := request(ctx, u, host, net.JoinHostPort(resolution.Address, port), event, start); err != nil {
+			fail(event, err)
+		}
+		return event
+	})
+}
+
+// request GETs u from addr on a new connection and records the status and
+// the time taken by each phase on event. The trace callbacks run on the
+// goroutines of the transport, which can outlive a request cut short by ctx,
+// so their timings are only copied to event once the request returned.
+func request(ctx context.Context, u *url.URL, host string, addr string, event *ProbeEvent, start time.Time) error {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:   &tls.Config{ServerName: host},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	httpClient := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var mu sync.Mutex
+	var connectStart, tlsStart, wroteRequest time.Time
+	var connect, tlsTime, ttfb, firstByte time.Duration
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			connect = time.Since(connectStart)
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsTime = time.Since(tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			ttfb = time.Since(wroteRequest)
+			firstByte = time.Since(start)
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "NetMirror-httping")
+
+	resp, err := httpClient.Do(req)
+
+	mu.Lock()
+	event.Connect, event.TLS, event.TTFB, event.Latency = connect, tlsTime, ttfb, firstByte
+	mu.Unlock()
+
+	if err != nil {
+		event.Latency = time.Since(start)
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	event.Status = resp.StatusCode
+	return nil
+}
+
+// parseHTTPTarget parses an http(s) URL or a bare host, which is requested
+// over HTTPS
+func parseHTTPTarget(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, errors.New("Invalid IP Address")
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" || u.User != nil {
+		return nil, errors.New("Invalid URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("Only http and https URLs are supported")
+	}
+	return u, nil
+}
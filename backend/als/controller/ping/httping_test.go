@@ -0,0 +1,54 @@
+package ping
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestRequestSlowTLSHandshake times out attempts in the TLS handshake, whose
+// trace callbacks may only run after request returned. Run it with -race.
+func TestRequestSlowTLSHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Never answer the ClientHello
+			go func() {
+				time.Sleep(300 * time.Millisecond)
+				conn.Close()
+			}()
+		}
+	}()
+
+	u, _ := url.Parse("https://example.com/")
+	for seq := 1; seq <= 5; seq++ {
+		event := &ProbeEvent{Seq: seq}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := request(ctx, u, "example.com", ln.Addr().String(), event, time.Now())
+		cancel()
+		if err == nil {
+			t.Fatalf("seq %d: expected the handshake to time out", seq)
+		}
+		fail(event, err)
+		if !event.IsTimeout {
+			t.Errorf("seq %d: expected a timeout, got %+v", seq, event)
+		}
+		if _, err := json.Marshal(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Give late callbacks the chance to run while nothing waits for them
+	time.Sleep(400 * time.Millisecond)
+}
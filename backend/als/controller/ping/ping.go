@@ -1,18 +1,34 @@
 package ping
 
 import (
+	"context"
 	"encoding/json"
+	"net"
 
 	"github.com/gin-gonic/gin"
 	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller"
+	"github.com/X-Zero-L/als/als/target"
+	"github.com/X-Zero-L/als/config"
 	"github.com/samlm0/go-ping"
 )
 
+// Handle pings the target over IPv4 unless another family is asked for
 func Handle(c *gin.Context) {
+	handle(c, "ping", c.DefaultQuery("family", target.FamilyIPv4), "Ping")
+}
+
+// HandlePing6 pings the target over IPv6
+func HandlePing6(c *gin.Context) {
+	handle(c, "ping6", target.FamilyIPv6, "Ping6")
+}
+
+// handle streams a PacketEvent named eventName for every sequence and a
+// PingSummary at the end. IPv4 is pinged with go-ping, IPv6 with pinger6.
+func handle(c *gin.Context, tool string, family string, eventName string) {
 	ip, ok := c.GetQuery("ip")
 	v, _ := c.Get("clientSession")
 	clientSession := v.(*client.ClientSession)
-	channel := clientSession.Channel
 	if !ok || ip == "" {
 		c.JSON(400, &gin.H{
 			"success": false,
@@ -21,31 +37,79 @@ func Handle(c *gin.Context) {
 		return
 	}
 
-	p, err := ping.New(ip)
+	params, err := controller.ParseToolParams(c, config.Get().Ping)
 	if err != nil {
 		c.JSON(400, &gin.H{
 			"success": false,
-			"error":   "Invaild IP Address",
+			"error":   err.Error(),
 		})
 		return
 	}
 
-	p.Count = 10
-	p.OnEvent = func(event *ping.PacketEvent, _ error) {
+	addr, ok := controller.ResolveTarget(c, tool, ip, family)
+	if !ok {
+		return
+	}
+
+	stats := newSummary()
+	onEvent := func(event *ping.PacketEvent) {
+		stats.add(event.Seq, event.IsTimeout, event.Latency)
 		content, err := json.Marshal(event)
 		if err != nil {
 			return
 		}
 		msg := &client.Message{
-			Name:    "Ping",
+			Name:    eventName,
 			Content: string(content),
 		}
-		channel <- msg
+		// The run may end with the session, do not wait for it then
+		clientSession.Send(msg)
+	}
+	ctx, cancel := context.WithTimeout(clientSession.GetContext(c.Request.Context()), params.Timeout)
+	defer cancel()
+
+	if net.ParseIP(addr).To4() == nil {
+		p, err := newPinger6(addr)
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"success": false,
+				"error":   "Failed to open ICMPv6 socket: " + err.Error(),
+			})
+			return
+		}
+		p.count = params.Count
+		if params.Interval > 0 {
+			p.interval = params.Interval
+		}
+		if params.PacketSize > 0 {
+			p.size = params.PacketSize
+		}
+		p.onEvent = onEvent
+		p.Start(ctx)
+	} else {
+		p, err := ping.New(addr)
+		if err != nil {
+			c.JSON(400, &gin.H{
+				"success": false,
+				"error":   "Invaild IP Address",
+			})
+			return
+		}
+		p.Count = params.Count
+		if params.Interval > 0 {
+			p.Interval = params.Interval
+		}
+		if params.PacketSize > 0 {
+			p.Size = params.PacketSize
+		}
+		p.OnEvent = func(event *ping.PacketEvent, _ error) {
+			onEvent(event)
+		}
+		p.Start(ctx)
 	}
-	ctx := clientSession.GetContext(c.Request.Context())
-	p.Start(ctx)
 
 	c.JSON(200, &gin.H{
 		"success": true,
+		"summary": stats.send(c, clientSession),
 	})
 }
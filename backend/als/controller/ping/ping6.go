@@ -2,303 +2,250 @@ package ping
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"crypto/rand"
+	"errors"
+	mrand "math/rand"
 	"net"
-	"os/exec"
-	"regexp"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/gin-gonic/gin"
-	"github.com/X-Zero-L/als/als/client"
+	"github.com/samlm0/go-ping"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
 )
 
-// Ping6Response represents a single ping response
-type Ping6Response struct {
-	From      string `json:"from"`
-	Seq       int    `json:"seq"`
-	TTL       int    `json:"ttl"`
-	Latency   int64  `json:"latency"`
-	IsTimeout bool   `json:"is_timeout"`
+// replyTimeout is how long a reply is waited for before the sequence is
+// reported as timed out
+const replyTimeout = 5 * time.Second
+
+// pinger6 sends ICMPv6 echo requests to one address. Replies are matched to
+// their request by identifier and sequence number, so neither other pings on
+// this node nor late replies are mistaken for an answer.
+type pinger6 struct {
+	addr     *net.IPAddr
+	count    int
+	interval time.Duration
+	size     int
+	onEvent  func(*ping.PacketEvent)
+
+	conn    *icmp.PacketConn
+	dst     net.Addr
+	id      int
+	matchID bool // false when the kernel picks the identifier
 }
 
-// HandlePing6 handles IPv6 ping requests
-func HandlePing6(c *gin.Context) {
-	ip, ok := c.GetQuery("ip")
-	if !ok || ip == "" {
-		// Get client session first to send error message
-		v, exists := c.Get("clientSession")
-		if exists {
-			clientSession := v.(*client.ClientSession)
-			// Send error message through WebSocket
-			errorResp := Ping6Response{
-				From:      "Error: No IP provided",
-				Seq:       1,
-				TTL:       0,
-				Latency:   0,
-				IsTimeout: true,
-			}
-			jsonData, _ := json.Marshal(errorResp)
-			clientSession.Channel <- &client.Message{
-				Name:    "Ping6",
-				Content: string(jsonData),
-			}
-		}
-		
-		c.JSON(400, &gin.H{
-			"success": false,
-			"error":   "Invalid IP Address",
-		})
-		return
-	}
+// reply6 is an echo reply read from the connection
+type reply6 struct {
+	seq      int // as on the wire, only 16 bits
+	from     string
+	size     int
+	hopLimit int
+	received time.Time
+}
 
-	// Validate input to prevent command injection
-	// Allow only valid IPv6 addresses or hostnames
-	if !isValidIPv6OrHostname(ip) {
-		// Get client session first to send error message
-		v, exists := c.Get("clientSession")
-		if exists {
-			clientSession := v.(*client.ClientSession)
-			// Send error message through WebSocket
-			errorResp := Ping6Response{
-				From:      "Error: Invalid input",
-				Seq:       1,
-				TTL:       0,
-				Latency:   0,
-				IsTimeout: true,
-			}
-			jsonData, _ := json.Marshal(errorResp)
-			clientSession.Channel <- &client.Message{
-				Name:    "Ping6",
-				Content: string(jsonData),
-			}
-		}
-		
-		c.JSON(400, &gin.H{
-			"success": false,
-			"error":   "Invalid IPv6 address or hostname",
-		})
-		return
+// newPinger6 opens a raw ICMPv6 socket, falling back to the unprivileged
+// datagram socket of Linux when raw sockets are not allowed
+func newPinger6(addr string) (*pinger6, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return nil, errors.New(addr + " is not an IPv6 address")
 	}
 
-	v, exists := c.Get("clientSession")
-	if !exists {
-		c.JSON(500, &gin.H{
-			"success": false,
-			"error":   "Client session not found",
-		})
-		return
+	p := &pinger6{
+		addr:     &net.IPAddr{IP: ip},
+		interval: time.Second,
+		size:     56,
+		id:       mrand.Intn(0x10000),
+		matchID:  true,
 	}
 
-	clientSession := v.(*client.ClientSession)
-
-	fmt.Printf("[Ping6] Request received for IP: %s\n", ip)
-
-	// Create timeout context
-	timeout := 30 * time.Second
-	ctx, cancel := context.WithTimeout(clientSession.GetContext(c.Request.Context()), timeout)
-	defer cancel()
-
-	// Build ping6 command - Alpine uses ping -6 instead of ping6
-	var cmd *exec.Cmd
-	if _, err := exec.LookPath("ping6"); err == nil {
-		cmd = exec.CommandContext(ctx, "ping6", "-c", "10", ip)
-		fmt.Println("[Ping6] Using ping6 command")
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err == nil {
+		// Only echo replies are of interest, leave the rest to the kernel
+		var filter ipv6.ICMPFilter
+		filter.SetAll(true)
+		filter.Accept(ipv6.ICMPTypeEchoReply)
+		conn.IPv6PacketConn().SetICMPFilter(&filter)
+		p.dst = p.addr
 	} else {
-		// Alpine Linux uses ping with -6 flag
-		cmd = exec.CommandContext(ctx, "ping", "-6", "-c", "10", ip)
-		fmt.Println("[Ping6] Using ping -6 command (Alpine)")
-	}
-
-	// Start the command
-	output, err := cmd.StdoutPipe()
-	if err != nil {
-		// Send error message through WebSocket
-		errorResp := Ping6Response{
-			From:      fmt.Sprintf("Error: %s", err.Error()),
-			Seq:       1,
-			TTL:       0,
-			Latency:   0,
-			IsTimeout: true,
-		}
-		jsonData, _ := json.Marshal(errorResp)
-		clientSession.Channel <- &client.Message{
-			Name:    "Ping6",
-			Content: string(jsonData),
+		var dgramErr error
+		conn, dgramErr = icmp.ListenPacket("udp6", "::")
+		if dgramErr != nil {
+			return nil, err
 		}
-		
-		c.JSON(400, &gin.H{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
+		// The kernel replaces the identifier with one of its own and only
+		// hands over the replies to it
+		p.dst = &net.UDPAddr{IP: ip}
+		p.matchID = false
 	}
+	conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	p.conn = conn
+	return p, nil
+}
 
-	err = cmd.Start()
-	if err != nil {
-		fmt.Printf("[Ping6] Failed to start command: %v\n", err)
-		// Send error message through WebSocket
-		errorResp := Ping6Response{
-			From:      fmt.Sprintf("Error: %s", err.Error()),
-			Seq:       1,
-			TTL:       0,
-			Latency:   0,
-			IsTimeout: true,
-		}
-		jsonData, _ := json.Marshal(errorResp)
-		clientSession.Channel <- &client.Message{
-			Name:    "Ping6",
-			Content: string(jsonData),
+// Start sends count echo requests and reports an event for every sequence,
+// either when its reply arrives or when it times out. It returns once every
+// sequence is reported or ctx is done, the sequences still waiting for a
+// reply then are reported as timed out.
+func (p *pinger6) Start(ctx context.Context) {
+	defer p.conn.Close()
+
+	replies := make(chan reply6)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.receive(replies, done)
+	}()
+	defer wg.Wait()
+	defer close(done)
+	// Unblocks the receiver once the pinger is done
+	defer p.conn.SetReadDeadline(time.Now())
+
+	sent := make(map[int]time.Time)
+	var pending []int // sequences waiting for a reply, in sending order
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	expiry := time.NewTimer(replyTimeout)
+	defer expiry.Stop()
+
+	seq := 1
+	send := func() {
+		sentAt, err := p.send(seq)
+		if err != nil {
+			p.onEvent(&ping.PacketEvent{Seq: seq, IsTimeout: true})
+		} else {
+			sent[seq] = sentAt
+			pending = append(pending, seq)
 		}
-		
-		c.JSON(400, &gin.H{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
+		seq++
 	}
-
-	// Send initial message
-	fmt.Printf("[Ping6] Command started successfully\n")
-
-	// Read output in a goroutine but don't block with cmd.Wait()
-	// Let the goroutine handle the output and the handler can return
-	go func() {
-		defer func() {
-			if cmd.Process != nil {
-				cmd.Process.Kill()
+	send()
+
+	for {
+		// Report the sequences whose reply is overdue
+		for len(pending) > 0 {
+			first := pending[0]
+			sentAt, waiting := sent[first]
+			if waiting && time.Since(sentAt) < replyTimeout {
+				expiry.Reset(replyTimeout - time.Since(sentAt))
+				break
 			}
-		}()
-
-		buf := make([]byte, 1024)
-		remainingData := ""
-		seq := 0
-
-		for {
-			n, err := output.Read(buf)
-			if err != nil {
-				fmt.Printf("[Ping6] Read error: %v\n", err)
-				return
+			pending = pending[1:]
+			if waiting {
+				delete(sent, first)
+				p.onEvent(&ping.PacketEvent{Seq: first, IsTimeout: true})
 			}
+		}
+		if seq > p.count && len(sent) == 0 {
+			return
+		}
 
-			data := remainingData + string(buf[:n])
-			lines := strings.Split(data, "\n")
-
-			// Keep the last incomplete line for next iteration
-			if !strings.HasSuffix(data, "\n") && len(lines) > 1 {
-				remainingData = lines[len(lines)-1]
-				lines = lines[:len(lines)-1]
-			} else {
-				remainingData = ""
+		select {
+		case <-ctx.Done():
+			for _, waitingSeq := range pending {
+				if _, waiting := sent[waitingSeq]; waiting {
+					p.onEvent(&ping.PacketEvent{Seq: waitingSeq, IsTimeout: true})
+				}
 			}
-
-			for _, line := range lines {
-				if strings.TrimSpace(line) == "" {
-					continue
+			return
+		case <-ticker.C:
+			if seq <= p.count {
+				send()
+			}
+		case <-expiry.C:
+		case r := <-replies:
+			// The oldest sequence still waiting with the same low bits
+			replied := 0
+			for _, pendingSeq := range pending {
+				if _, waiting := sent[pendingSeq]; waiting && pendingSeq&0xffff == r.seq {
+					replied = pendingSeq
+					break
 				}
+			}
+			if replied == 0 {
+				// Already reported as timed out
+				continue
+			}
+			sentAt := sent[replied]
+			delete(sent, replied)
+			p.onEvent(&ping.PacketEvent{
+				Seq:     replied,
+				From:    r.from,
+				Size:    r.size,
+				TTL:     r.hopLimit,
+				Latency: r.received.Sub(sentAt),
+			})
+		}
+	}
+}
 
-				fmt.Printf("[Ping6] Output line: %s\n", line)
-
-				// Parse ping output
-				// Example: "64 bytes from 2001:db8::1: icmp_seq=1 ttl=64 time=0.456 ms"
-				if strings.Contains(line, "bytes from") && strings.Contains(line, "icmp_seq=") {
-					seq++
-					resp := Ping6Response{
-						Seq:       seq,
-						IsTimeout: false,
-					}
-
-					// Extract from address
-					fromRegex := regexp.MustCompile(`from ([^\s:]+)`)
-					if matches := fromRegex.FindStringSubmatch(line); len(matches) > 1 {
-						resp.From = matches[1]
-					}
+// send writes the echo request of seq and returns when it was sent
+func (p *pinger6) send(seq int) (time.Time, error) {
+	body := make([]byte, p.size)
+	_, _ = rand.Read(body)
 
-					// Extract TTL
-					ttlRegex := regexp.MustCompile(`ttl=(\d+)`)
-					if matches := ttlRegex.FindStringSubmatch(line); len(matches) > 1 {
-						if ttl, err := strconv.Atoi(matches[1]); err == nil {
-							resp.TTL = ttl
-						}
-					}
+	message := &icmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Body: &icmp.Echo{ID: p.id, Seq: seq & 0xffff, Data: body},
+	}
+	// The kernel fills in the ICMPv6 checksum
+	data, err := message.Marshal(nil)
+	if err != nil {
+		return time.Time{}, err
+	}
 
-					// Extract time in ms and convert to nanoseconds
-					timeRegex := regexp.MustCompile(`time=([\d.]+) ms`)
-					if matches := timeRegex.FindStringSubmatch(line); len(matches) > 1 {
-						if timeMs, err := strconv.ParseFloat(matches[1], 64); err == nil {
-							resp.Latency = int64(timeMs * 1000000) // Convert ms to ns
-						}
-					}
+	sentAt := time.Now()
+	p.conn.SetWriteDeadline(sentAt.Add(replyTimeout))
+	_, err = p.conn.WriteTo(data, p.dst)
+	return sentAt, err
+}
 
-					// Send the response
-					jsonData, _ := json.Marshal(resp)
-					// Use select to avoid blocking if context is cancelled
-					select {
-					case clientSession.Channel <- &client.Message{
-						Name:    "Ping6",
-						Content: string(jsonData),
-					}:
-					case <-ctx.Done():
-						return
-					}
-				} else if strings.Contains(line, "no answer yet") || strings.Contains(line, "Request timeout") {
-					// Handle timeout
-					seq++
-					resp := Ping6Response{
-						Seq:       seq,
-						IsTimeout: true,
-					}
+// receive reads the echo replies of this pinger until its read deadline is
+// set or done is closed
+func (p *pinger6) receive(replies chan<- reply6, done <-chan struct{}) {
+	buf := make([]byte, 65536)
+	for {
+		n, cm, src, err := p.conn.IPv6PacketConn().ReadFrom(buf)
+		received := time.Now()
+		if err != nil {
+			return
+		}
 
-					jsonData, _ := json.Marshal(resp)
-					clientSession.Channel <- &client.Message{
-						Name:    "Ping6",
-						Content: string(jsonData),
-					}
-				}
-			}
+		message, err := icmp.ParseMessage(ipv6.ICMPTypeEchoReply.Protocol(), buf[:n])
+		if err != nil || message.Type != ipv6.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := message.Body.(*icmp.Echo)
+		if !ok || (p.matchID && echo.ID != p.id) {
+			continue
 		}
-	}()
 
-	// Return immediately to let the goroutine handle output
-	c.JSON(200, &gin.H{
-		"success": true,
-	})
-}
+		from := src.String()
+		if addr, ok := src.(*net.UDPAddr); ok {
+			from = addr.IP.String()
+		} else if addr, ok := src.(*net.IPAddr); ok {
+			from = addr.IP.String()
+		}
+		if from != p.addr.IP.String() {
+			continue
+		}
 
-// isValidIPv6OrHostname validates if the input is a valid IPv6 address or hostname
-func isValidIPv6OrHostname(input string) bool {
-	// Check if it's a valid IPv6 address
-	if net.ParseIP(input) != nil {
-		return true
-	}
-	
-	// Check if it's a valid hostname (DNS name)
-	// Allow only alphanumeric, dots, hyphens, and underscores
-	// Must not contain shell special characters
-	hostnameRegex := regexp.MustCompile(`^[a-zA-Z0-9.-]+$`)
-	if !hostnameRegex.MatchString(input) {
-		return false
-	}
-	
-	// Additional checks for shell injection attempts
-	dangerousPatterns := []string{
-		";", "&", "|", "`", "$", "(", ")", "{", "}", "[", "]",
-		"<", ">", "\\", "'", "\"", "\n", "\r", "\t",
-		"*", "?", "~", "!", "#", "%", "^", "=", "+",
-	}
-	
-	for _, pattern := range dangerousPatterns {
-		if strings.Contains(input, pattern) {
-			return false
+		r := reply6{
+			seq:      echo.Seq,
+			from:     from,
+			size:     n,
+			received: received,
+		}
+		if cm != nil {
+			r.hopLimit = cm.HopLimit
+		}
+		select {
+		case replies <- r:
+		case <-done:
+			return
 		}
 	}
-	
-	// Check length limits
-	if len(input) > 255 {
-		return false
-	}
-	
-	return true
-}
\ No newline at end of file
+}
@@ -0,0 +1,132 @@
+package ping
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller"
+	"github.com/X-Zero-L/als/als/target"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// ProbeEvent is a single TCP, UDP or HTTP ping attempt. It has the fields of
+// ping.PacketEvent, so clients can handle every ping mode alike.
+type ProbeEvent struct {
+	IsTimeout bool          `json:"is_timeout"` // no answer, Error tells why
+	From      string        `json:"from"`
+	Seq       int           `json:"seq"`
+	Latency   time.Duration `json:"latency"`
+	Port      int           `json:"port"`
+	Error     string        `json:"error,omitempty"`
+
+	// HTTP only. Latency covers every phase up to the first response byte.
+	Status  int           `json:"status,omitempty"`
+	DNS     time.Duration `json:"dns,omitempty"`
+	Connect time.Duration `json:"connect,omitempty"`
+	TLS     time.Duration `json:"tls,omitempty"`
+	TTFB    time.Duration `json:"ttfb,omitempty"` // from the request sent to the first response byte
+}
+
+// probeFunc runs attempt seq against addr, it returns once ctx is done at
+// the latest
+type probeFunc func(ctx context.Context, addr string, seq int) *ProbeEvent
+
+// handleProbe resolves host and runs probe with the count and interval of the
+// ping settings, streaming a ProbeEvent named eventName for every attempt
+// and a PingSummary at the end
+func handleProbe(c *gin.Context, tool string, eventName string, host string, probe probeFunc) {
+	v, _ := c.Get("clientSession")
+	clientSession := v.(*client.ClientSession)
+
+	params, err := controller.ParseToolParams(c, config.Get().Ping)
+	if err != nil {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	addr, ok := controller.ResolveTarget(c, tool, host, c.DefaultQuery("family", target.FamilyIPv4))
+	if !ok {
+		return
+	}
+
+	interval := params.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(clientSession.GetContext(c.Request.Context()), params.Timeout)
+	defer cancel()
+
+	// An attempt slower than the interval delays the next one
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	stats := newSummary()
+	for seq := 1; seq <= params.Count; seq++ {
+		if seq > 1 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, replyTimeout)
+		event := probe(attemptCtx, addr, seq)
+		attemptCancel()
+		if ctx.Err() != nil {
+			break
+		}
+		stats.add(seq, event.IsTimeout, event.Latency)
+
+		content, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		if !clientSession.Send(&client.Message{
+			Name:    eventName,
+			Content: string(content),
+		}) {
+			break
+		}
+	}
+
+	c.JSON(200, &gin.H{
+		"success": true,
+		"summary": stats.send(c, clientSession),
+	})
+}
+
+// fail records err on event. A refused connection or an unreachable port is
+// an answer from the target, anything else counts as no answer.
+func fail(event *ProbeEvent, err error) {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		event.Error = "connection refused"
+		return
+	}
+
+	event.IsTimeout = true
+	event.From = ""
+	event.Latency = 0
+
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		event.Error = "timed out"
+	case errors.As(err, &opErr):
+		event.Error = opErr.Err.Error()
+	default:
+		event.Error = err.Error()
+	}
+}
@@ -0,0 +1,122 @@
+package ping
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/X-Zero-L/als/als/client"
+	"github.com/gin-gonic/gin"
+)
+
+// PingSummary is sent as the last event of a ping run, times are in
+// milliseconds. Every ping mode computes it the same way.
+type PingSummary struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Loss     float64 `json:"loss"` // in percent
+	Min      float64 `json:"min"`
+	Avg      float64 `json:"avg"`
+	Max      float64 `json:"max"`
+	Mdev     float64 `json:"mdev"`   // standard deviation, as reported by ping
+	Jitter   float64 `json:"jitter"` // mean difference between consecutive replies
+	P50      float64 `json:"p50"`
+	P95      float64 `json:"p95"`
+}
+
+// summary collects the outcome of every sequence of a run
+type summary struct {
+	sent    int
+	replies map[int]time.Duration // latency by sequence
+}
+
+func newSummary() *summary {
+	return &summary{replies: make(map[int]time.Duration)}
+}
+
+// add records sequence seq, answered after latency unless it timed out
+func (s *summary) add(seq int, isTimeout bool, latency time.Duration) {
+	s.sent++
+	if !isTimeout {
+		s.replies[seq] = latency
+	}
+}
+
+// finish computes the summary of the sequences recorded so far
+func (s *summary) finish() *PingSummary {
+	result := &PingSummary{Sent: s.sent, Received: len(s.replies)}
+	if s.sent > 0 {
+		result.Loss = round(float64(s.sent-len(s.replies))/float64(s.sent)*100, 2)
+	}
+	if len(s.replies) == 0 {
+		return result
+	}
+
+	// Jitter follows the order the packets were sent in
+	seqs := make([]int, 0, len(s.replies))
+	for seq := range s.replies {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	latencies := make([]float64, len(seqs))
+	var sum, squares, jitter float64
+	for i, seq := range seqs {
+		ms := float64(s.replies[seq]) / float64(time.Millisecond)
+		latencies[i] = ms
+		sum += ms
+		squares += ms * ms
+		if i > 0 {
+			jitter += math.Abs(ms - latencies[i-1])
+		}
+	}
+
+	n := float64(len(latencies))
+	avg := sum / n
+	result.Avg = round(avg, 3)
+	result.Mdev = round(math.Sqrt(math.Max(squares/n-avg*avg, 0)), 3)
+	if len(latencies) > 1 {
+		result.Jitter = round(jitter/(n-1), 3)
+	}
+
+	sort.Float64s(latencies)
+	result.Min = round(latencies[0], 3)
+	result.Max = round(latencies[len(latencies)-1], 3)
+	result.P50 = round(percentile(latencies, 50), 3)
+	result.P95 = round(percentile(latencies, 95), 3)
+	return result
+}
+
+// send sends the PingSummary event to the session, unless it or the request
+// is gone, and returns the summary
+func (s *summary) send(c *gin.Context, clientSession *client.ClientSession) *PingSummary {
+	result := s.finish()
+	content, err := json.Marshal(result)
+	if err != nil {
+		return result
+	}
+
+	select {
+	case clientSession.Channel <- &client.Message{
+		Name:    "PingSummary",
+		Content: string(content),
+	}:
+	case <-clientSession.GetContext(c.Request.Context()).Done():
+	}
+	return result
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func round(v float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(v*scale) / scale
+}
@@ -0,0 +1,48 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/X-Zero-L/als/als/controller"
+	"github.com/gin-gonic/gin"
+)
+
+// HandleTCPing measures how long the TCP handshake with the port of the
+// target takes, 80 unless another port is asked for
+func HandleTCPing(c *gin.Context) {
+	ip, ok := c.GetQuery("ip")
+	if !ok || ip == "" {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   "Invalid IP Address",
+		})
+		return
+	}
+
+	port, err := controller.ParsePort(c, 80)
+	if err != nil {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	handleProbe(c, "tcping", "TCPing", ip, func(ctx context.Context, addr string, seq int) *ProbeEvent {
+		event := &ProbeEvent{From: addr, Seq: seq, Port: port}
+
+		var dialer net.Dialer
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+		event.Latency = time.Since(start)
+		if err != nil {
+			fail(event, err)
+			return event
+		}
+		conn.Close()
+		return event
+	})
+}
@@ -0,0 +1,80 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/X-Zero-L/als/als/controller"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+)
+
+// HandleUDPing sends a datagram to the port of the target, 53 unless another
+// port is asked for, and measures how long the answer takes. DNS servers are
+// sent a query for the root name servers, other ports an empty datagram. An
+// unreachable port is an answer as well, but many services stay silent on
+// unexpected datagrams, so no answer does not mean the target is down.
+func HandleUDPing(c *gin.Context) {
+	ip, ok := c.GetQuery("ip")
+	if !ok || ip == "" {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   "Invalid IP Address",
+		})
+		return
+	}
+
+	port, err := controller.ParsePort(c, 53)
+	if err != nil {
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	var payload []byte
+	if port == 53 {
+		query := new(dns.Msg)
+		query.SetQuestion(".", dns.TypeNS)
+		payload, _ = query.Pack()
+	}
+
+	handleProbe(c, "udping", "UDPing", ip, func(ctx context.Context, addr string, seq int) *ProbeEvent {
+		event := &ProbeEvent{From: addr, Seq: seq, Port: port}
+
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(addr, strconv.Itoa(port)))
+		if err != nil {
+			fail(event, err)
+			return event
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		stop := context.AfterFunc(ctx, func() {
+			conn.SetDeadline(time.Now())
+		})
+		defer stop()
+
+		start := time.Now()
+		if _, err := conn.Write(payload); err != nil {
+			fail(event, err)
+			return event
+		}
+		buf := make([]byte, 1500)
+		_, err = conn.Read(buf)
+		event.Latency = time.Since(start)
+		if err != nil {
+			fail(event, err)
+			if !event.IsTimeout {
+				// Refused by the ICMP port unreachable of the target
+				event.Error = "port unreachable"
+			}
+		}
+		return event
+	})
+}
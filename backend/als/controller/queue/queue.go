@@ -0,0 +1,36 @@
+package queue
+
+import (
+	"net/http"
+
+	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// GetJobs lists the queued and running jobs with the pool limits (admin only)
+func GetJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"jobs":         client.Jobs(),
+		"limits":       config.Get().Queue.Limits(),
+		"max_run_time": config.Get().Queue.MaxRunTime,
+	})
+}
+
+// CancelJob ends a queued or running job, its handler stops as if the client
+// went away (admin only)
+func CancelJob(c *gin.Context) {
+	if !client.CancelJob(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "Job not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Job cancelled successfully",
+	})
+}
@@ -20,24 +20,18 @@ func Handle(c *gin.Context) {
 	uuid := uuid.New().String()
 	// uuid := "1"
 	channel := make(chan *client.Message)
-	clientSession := &client.ClientSession{Channel: channel}
-	client.AddClient(uuid, clientSession)
+	clientSession := &client.ClientSession{Channel: channel, ClientIP: c.ClientIP()}
 	ctx, cancel := context.WithCancel(c.Request.Context())
 	defer cancel()
 	clientSession.SetContext(ctx)
+	client.AddClient(uuid, clientSession)
 
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
 	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 	c.SSEvent("SessionId", uuid)
-	_config := &sessionConfig{
-		ALSConfig: *config.Config,
-		ClientIP:  c.ClientIP(),
-	}
-
-	configJson, _ := json.Marshal(_config)
-	c.SSEvent("Config", string(configJson))
+	c.SSEvent("Config", configMessage(clientSession))
 	c.Writer.Flush()
 	interfaceCacheJson, _ := json.Marshal(timer.InterfaceCaches)
 	c.SSEvent("InterfaceCache", string(interfaceCacheJson))
@@ -57,6 +51,35 @@ func Handle(c *gin.Context) {
 	}
 
 FINISH:
-	close(channel)
+	// The channel stays open, senders give up on the cancelled context
+	cancel()
 	client.RemoveClient(uuid)
 }
+
+func configMessage(clientSession *client.ClientSession) string {
+	_config := &sessionConfig{
+		ALSConfig: *config.Get(),
+		ClientIP:  clientSession.ClientIP,
+	}
+
+	configJson, _ := json.Marshal(_config)
+	return string(configJson)
+}
+
+// BroadcastConfig pushes the current config to every connected session. Each
+// session gets it as soon as it is ready, or not at all once it is closed.
+func BroadcastConfig() {
+	client.ClientsMu.RLock()
+	sessions := make([]*client.ClientSession, 0, len(client.Clients))
+	for _, clientSession := range client.Clients {
+		sessions = append(sessions, clientSession)
+	}
+	client.ClientsMu.RUnlock()
+
+	for _, clientSession := range sessions {
+		go clientSession.Send(&client.Message{
+			Name:    "Config",
+			Content: configMessage(clientSession),
+		})
+	}
+}
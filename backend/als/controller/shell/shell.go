@@ -13,6 +13,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/config"
 )
 
 var upgrader = websocket.Upgrader{
@@ -44,7 +45,11 @@ func handleNewConnection(conn *websocket.Conn, session *client.ClientSession, gi
 
 	ex, _ := os.Executable()
 	fmt.Printf("[Shell] Starting shell process: %s --shell\n", ex)
-	c := exec.Command(ex, "--shell")
+	args := []string{"--shell"}
+	if config.ConfigFile != "" {
+		args = append(args, "--config", config.ConfigFile)
+	}
+	c := exec.Command(ex, args...)
 	ptmx, err := pty.Start(c)
 	if err != nil {
 		fmt.Printf("[Shell] Failed to start PTY: %v\n", err)
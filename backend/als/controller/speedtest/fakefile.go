@@ -1,15 +1,16 @@
 package speedtest
 
 import (
+	"context"
 	"crypto/rand"
-	"fmt"
+	"errors"
 	"io"
 	"regexp"
 	"strconv"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller"
 	"github.com/X-Zero-L/als/config"
 )
 
@@ -22,33 +23,6 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
-func sizeToBytes(size string) (int64, error) {
-	re := regexp.MustCompile(`^(\d+)(KB|MB|GB|TB)$`)
-	matches := re.FindStringSubmatch(size)
-
-	if matches == nil {
-		return 0, fmt.Errorf("invalid size format")
-	}
-
-	num, err := strconv.ParseInt(matches[1], 10, 64)
-	if err != nil {
-		return 0, err
-	}
-
-	switch strings.ToUpper(matches[2]) {
-	case "KB":
-		num *= 1024
-	case "MB":
-		num *= 1024 * 1024
-	case "GB":
-		num *= 1024 * 1024 * 1024
-	case "TB":
-		num *= 1024 * 1024 * 1024 * 1024
-	}
-
-	return num, nil
-}
-
 func HandleFakeFile(c *gin.Context) {
 	filename := c.Param("filename")
 	var re = regexp.MustCompile(`^(\d+)(KB|MB|GB|TB)\.test$`)
@@ -59,26 +33,35 @@ func HandleFakeFile(c *gin.Context) {
 		return
 	}
 
-	client.WaitQueue(c.Request.Context(), nil)
-
-	filename = filename[0 : len(filename)-5]
-	if !contains(config.Config.SpeedtestFileList, filename) {
+	name := filename[0 : len(filename)-5]
+	if !contains(config.Get().SpeedtestFileList, name) {
 		c.String(404, "404 file not found")
 		return
 	}
 
-	size, ok := sizeToBytes(filename)
+	size, ok := config.SizeToBytes(name)
 	if ok != nil {
 		c.String(404, "Invaild file size")
 		return
 	}
+
+	ctx, done := client.WaitQueue(c.Request.Context(), controller.QueueJob(c, client.PoolFileDownload, "file_speedtest", filename), nil)
+	defer done()
+	if ctx.Err() != nil {
+		message := "Stopped waiting in queue"
+		if cause := context.Cause(ctx); errors.Is(cause, client.ErrJobCancelled) || errors.Is(cause, client.ErrJobTimeout) {
+			message = cause.Error()
+		}
+		c.String(400, message)
+		return
+	}
 	c.Header("Content-Type", "application/octet-stream")
 	c.Header("Content-Length", strconv.FormatInt(size, 10))
 	c.Stream(func(w io.Writer) bool {
 		buf := make([]byte, 1024*1024)
 		rand.Read(buf)
 
-		for size > 0 {
+		for size > 0 && ctx.Err() == nil {
 			// 如果剩余的大小小于缓冲区的大小，只写入剩余的大小
 			if size < int64(len(buf)) {
 				buf = buf[:size]
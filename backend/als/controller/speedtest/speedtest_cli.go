@@ -3,6 +3,7 @@ package speedtest
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
@@ -13,6 +14,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/als/controller"
+	"github.com/X-Zero-L/als/config"
 )
 
 var count = 1
@@ -24,9 +27,10 @@ func fakeQueue() {
 		count++
 		lock.Unlock()
 		ctx, cancel := context.WithCancel(context.TODO())
-		client.WaitQueue(ctx, nil)
+		_, done := client.WaitQueue(ctx, client.Job{Pool: client.PoolSpeedtestCLI}, nil)
 		fmt.Println(count)
 		time.Sleep(time.Duration(count) * time.Second)
+		done()
 		cancel()
 	}()
 }
@@ -60,27 +64,44 @@ func HandleSpeedtestDotNet(c *gin.Context) {
 		return
 	}
 	closed := false
-	timeout := time.Second * 60
+	timeout := time.Second * time.Duration(config.Get().Speedtest.Timeout)
+	if timeout == 0 {
+		timeout = time.Second * time.Duration(config.Get().ToolTimeout)
+	}
 	count = 1
-	ctx, cancel := context.WithTimeout(clientSession.GetContext(c.Request.Context()), timeout)
+	// Wait for as long as the session lasts, the timeout only covers the run
+	sessionCtx := clientSession.GetContext(c.Request.Context())
+	queueCtx, done := client.WaitQueue(sessionCtx, controller.QueueJob(c, client.PoolSpeedtestCLI, "speedtest_dot_net", nodeId), func(pos int, totalPos int) {
+		msg, _ := json.Marshal(gin.H{"type": "queue", "pos": pos, "totalPos": totalPos})
+		select {
+		case clientSession.Channel <- &client.Message{
+			Name:    "SpeedtestStream",
+			Content: string(msg),
+		}:
+		case <-sessionCtx.Done():
+		}
+	})
+	defer done()
+	if queueCtx.Err() != nil {
+		message := "Stopped waiting in queue"
+		if cause := context.Cause(queueCtx); errors.Is(cause, client.ErrJobCancelled) {
+			message = cause.Error()
+		}
+		c.JSON(400, &gin.H{
+			"success": false,
+			"error":   message,
+		})
+		return
+	}
+	runCtx, cancel := context.WithTimeout(queueCtx, timeout)
 	defer func() {
 		cancel()
 		closed = true
 	}()
 	go func() {
-		<-ctx.Done()
+		<-runCtx.Done()
 		closed = true
 	}()
-	client.WaitQueue(ctx, func() {
-		pos, totalPos := client.GetQueuePostitionByCtx(ctx)
-		msg, _ := json.Marshal(gin.H{"type": "queue", "pos": pos, "totalPos": totalPos})
-		if !closed {
-			clientSession.Channel <- &client.Message{
-				Name:    "SpeedtestStream",
-				Content: string(msg),
-			}
-		}
-	})
 	args := []string{"--accept-license", "--accept-gdpr", "-f", "jsonl"}
 	if nodeId != "" {
 		args = append(args, "-s", nodeId)
@@ -89,7 +110,7 @@ func HandleSpeedtestDotNet(c *gin.Context) {
 	fmt.Printf("[SpeedtestDotNet] Running command: speedtest %s\n", strings.Join(args, " "))
 
 	go func() {
-		<-ctx.Done()
+		<-runCtx.Done()
 		if cmd.Process != nil {
 			cmd.Process.Kill()
 		}
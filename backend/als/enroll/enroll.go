@@ -0,0 +1,116 @@
+package enroll
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/X-Zero-L/als/config"
+)
+
+// errNotEnrolled means the controller removed the node, it has to enroll again
+var errNotEnrolled = errors.New("node is not enrolled")
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Run registers this node into the controller and sends heartbeats until the
+// process exits. Failed registrations are retried with a growing delay.
+func Run() {
+	backoff := time.Second
+	nodeID := ""
+	for {
+		if nodeID == "" {
+			id, err := register()
+			if err != nil {
+				log.Default().Printf("WARN: Failed to enroll into %s: %v", config.Get().ControllerURL, err)
+				time.Sleep(backoff)
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+				continue
+			}
+			nodeID, backoff = id, time.Second
+			log.Default().Printf("Enrolled into %s as node %s", config.Get().ControllerURL, nodeID)
+		}
+
+		time.Sleep(time.Duration(config.Get().HeartbeatInterval) * time.Second)
+		if err := heartbeat(nodeID); err != nil {
+			log.Default().Printf("WARN: Heartbeat to %s failed: %v", config.Get().ControllerURL, err)
+			if errors.Is(err, errNotEnrolled) {
+				nodeID = ""
+			}
+		}
+	}
+}
+
+// register enrolls the node and returns its ID on the controller
+func register() (string, error) {
+	cfg := config.Get()
+	location := cfg.CurrentNodeLocation
+	if location == "" {
+		location = cfg.Location
+	}
+
+	payload, _ := json.Marshal(struct {
+		Name     string `json:"name"`
+		Location string `json:"location"`
+		URL      string `json:"url"`
+		config.NodeMetadata
+	}{cfg.CurrentNodeName, location, cfg.CurrentNodeURL, cfg.AdvertisedMetadata()})
+
+	var body struct {
+		NodeID string `json:"node_id"`
+	}
+	if _, err := post("/api/enroll", payload, &body); err != nil {
+		return "", err
+	}
+	return body.NodeID, nil
+}
+
+func heartbeat(nodeID string) error {
+	status, err := post("/api/enroll/"+nodeID+"/heartbeat", nil, nil)
+	if status == http.StatusNotFound {
+		return errNotEnrolled
+	}
+	return err
+}
+
+// post sends an authenticated request to the controller and decodes the
+// answer into out, it returns the HTTP status if the controller answered
+func post(path string, payload []byte, out interface{}) (int, error) {
+	cfg := config.Get()
+	req, err := http.NewRequest("POST", strings.TrimRight(cfg.ControllerURL, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", cfg.EnrollmentToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &body) == nil && body.Error != "" {
+			return resp.StatusCode, fmt.Errorf("%s (HTTP %d)", body.Error, resp.StatusCode)
+		}
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,254 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+const window = time.Minute
+
+// retryBusy is the delay suggested to a client that hit a concurrency cap,
+// there is no way to know when one of its jobs ends
+const retryBusy = 10 * time.Second
+
+// Requests of each client IP and tool in the last minute, and the jobs and
+// sessions each client IP has open
+var (
+	requests = make(map[string][]time.Time)
+	jobs     = make(map[string]int)
+	sessions = make(map[string]int)
+	mu       sync.Mutex
+)
+
+type exemptKey struct{}
+
+// WithoutLimits marks the requests made with ctx as exempt, for jobs the
+// controller already limited before handing them to an agent
+func WithoutLimits(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exemptKey{}, true)
+}
+
+func isExempt(c *gin.Context) bool {
+	if exempt, _ := c.Request.Context().Value(exemptKey{}).(bool); exempt {
+		return true
+	}
+	return config.Get().RateLimit.IsExempt(c.ClientIP())
+}
+
+// allowRequests records n requests of ip to tool if they are within the per
+// minute limit, otherwise it returns how long until they are allowed
+func allowRequests(ip string, tool string, limit int, n int) (bool, time.Duration) {
+	if limit == 0 {
+		return true, 0
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := ip + " " + tool
+	now := time.Now()
+	recent := prune(requests[key], now)
+	if len(recent)+n > limit {
+		requests[key] = recent
+		if n > limit {
+			return false, window
+		}
+		return false, recent[len(recent)+n-limit-1].Add(window).Sub(now)
+	}
+	for i := 0; i < n; i++ {
+		recent = append(recent, now)
+	}
+	requests[key] = recent
+	return true, 0
+}
+
+// prune drops the requests older than the window
+func prune(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= window {
+		i++
+	}
+	return times[i:]
+}
+
+// acquire takes one of the limit slots of ip in counts, it reports false if
+// they are all taken
+func acquire(counts map[string]int, ip string, limit int) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if limit > 0 && counts[ip] >= limit {
+		return false
+	}
+	counts[ip]++
+	return true
+}
+
+// acquireUpTo takes up to want of the limit slots of ip in counts and returns
+// how many it took, 0 if they are all taken
+func acquireUpTo(counts map[string]int, ip string, limit int, want int) int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if limit > 0 && counts[ip]+want > limit {
+		want = limit - counts[ip]
+	}
+	if want <= 0 {
+		return 0
+	}
+	counts[ip] += want
+	return want
+}
+
+// release gives n slots of ip in counts back
+func release(counts map[string]int, ip string, n int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if counts[ip] -= n; counts[ip] <= 0 {
+		delete(counts, ip)
+	}
+}
+
+// checkRequests rejects the request if the client IP sent too many to tool in
+// the last minute, counting it as n requests
+func checkRequests(c *gin.Context, tool string, n int) bool {
+	limit := config.Get().RateLimit.RequestLimit(tool)
+	if ok, retryAfter := allowRequests(c.ClientIP(), tool, limit, n); !ok {
+		reject(c, tool, fmt.Sprintf("Too many %s requests, at most %d per minute", tool, limit), retryAfter)
+		return false
+	}
+	return true
+}
+
+// Requests limits how many requests per minute a client IP may send to tool
+func Requests(tool string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isExempt(c) || checkRequests(c, tool, 1) {
+			c.Next()
+		}
+	}
+}
+
+// Job limits the requests per minute like Requests, and how many tool runs a
+// client IP may have at the same time
+func Job(tool string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isExempt(c) {
+			c.Next()
+			return
+		}
+		if !checkRequests(c, tool, 1) {
+			return
+		}
+
+		cfg := config.Get().RateLimit
+		ip := c.ClientIP()
+		if !acquire(jobs, ip, cfg.MaxConcurrentJobs) {
+			reject(c, tool, fmt.Sprintf("Too many jobs running, at most %d at the same time", cfg.MaxConcurrentJobs), retryBusy)
+			return
+		}
+		defer release(jobs, ip, 1)
+		c.Next()
+	}
+}
+
+// Fanout counts a run of tool on n nodes against the limits of the client IP:
+// as n requests to tool, and as up to parallel jobs, as many as the client IP
+// has free. It returns how many nodes may be measured at the same time and
+// the function that frees the jobs again, or 0 once it answered 429.
+func Fanout(c *gin.Context, tool string, n int, parallel int) (int, func()) {
+	if isExempt(c) {
+		return parallel, func() {}
+	}
+	if !checkRequests(c, tool, n) {
+		return 0, nil
+	}
+
+	cfg := config.Get().RateLimit
+	ip := c.ClientIP()
+	taken := acquireUpTo(jobs, ip, cfg.MaxConcurrentJobs, parallel)
+	if taken == 0 {
+		reject(c, tool, fmt.Sprintf("Too many jobs running, at most %d at the same time", cfg.MaxConcurrentJobs), retryBusy)
+		return 0, nil
+	}
+	return taken, func() { release(jobs, ip, taken) }
+}
+
+// Session limits how many sessions a client IP may have open
+func Session(c *gin.Context) {
+	if isExempt(c) {
+		c.Next()
+		return
+	}
+
+	cfg := config.Get().RateLimit
+	ip := c.ClientIP()
+	if !acquire(sessions, ip, cfg.MaxSessions) {
+		reject(c, "session", fmt.Sprintf("Too many sessions open, at most %d at the same time", cfg.MaxSessions), retryBusy)
+		return
+	}
+	defer release(sessions, ip, 1)
+	c.Next()
+}
+
+// reject answers 429 and tells the session of the request, if any, which
+// limit was hit
+func reject(c *gin.Context, tool string, message string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	if v, ok := c.Get("clientSession"); ok {
+		content, _ := json.Marshal(gin.H{
+			"tool":        tool,
+			"message":     message,
+			"retry_after": seconds,
+		})
+		select {
+		case v.(*client.ClientSession).Channel <- &client.Message{
+			Name:    "RateLimited",
+			Content: string(content),
+		}:
+		default:
+			// The session is busy or gone, the response still explains it
+		}
+	}
+
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"success":     false,
+		"error":       message,
+		"retry_after": seconds,
+	})
+}
+
+// RunCleanup periodically forgets the requests that left the window, so
+// clients that went away do not keep memory
+func RunCleanup() {
+	for {
+		time.Sleep(window)
+
+		now := time.Now()
+		mu.Lock()
+		for key, times := range requests {
+			if recent := prune(times, now); len(recent) > 0 {
+				requests[key] = recent
+			} else {
+				delete(requests, key)
+			}
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,51 @@
+package als
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/X-Zero-L/als/als/controller/session"
+	"github.com/X-Zero-L/als/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Reload re-reads the configuration and pushes it to connected sessions.
+// Running sessions, queued jobs and iperf3 servers are left untouched.
+func Reload() error {
+	if err := config.Reload(); err != nil {
+		return err
+	}
+	session.BroadcastConfig()
+	return nil
+}
+
+// watchReloadSignal reloads the configuration on SIGHUP
+func watchReloadSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Default().Println("Received SIGHUP, reloading config...")
+		if err := Reload(); err != nil {
+			log.Default().Printf("Failed to reload config: %v", err)
+		}
+	}
+}
+
+// handleReloadConfig reloads the configuration (admin only)
+func handleReloadConfig(c *gin.Context) {
+	if err := Reload(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Config reloaded successfully",
+	})
+}
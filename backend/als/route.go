@@ -10,13 +10,16 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/X-Zero-L/als/als/controller"
 	"github.com/X-Zero-L/als/als/controller/cache"
+	"github.com/X-Zero-L/als/als/controller/federation"
 	"github.com/X-Zero-L/als/als/controller/iperf3"
 	"github.com/X-Zero-L/als/als/controller/nettools"
 	"github.com/X-Zero-L/als/als/controller/nodes"
 	"github.com/X-Zero-L/als/als/controller/ping"
+	"github.com/X-Zero-L/als/als/controller/queue"
 	"github.com/X-Zero-L/als/als/controller/session"
 	"github.com/X-Zero-L/als/als/controller/shell"
 	"github.com/X-Zero-L/als/als/controller/speedtest"
+	"github.com/X-Zero-L/als/als/ratelimit"
 	"github.com/X-Zero-L/als/config"
 	iEmbed "github.com/X-Zero-L/als/embed"
 )
@@ -37,7 +40,7 @@ func SetupHttpRoute(e *gin.Engine) {
 		c.Next()
 	})
 
-	e.GET("/session", session.Handle)
+	e.GET("/session", ratelimit.Session, session.Handle)
 	
 	// BGP graph proxy endpoint with 24-hour caching
 	e.GET("/bgp/graph/:asn/:type", func(c *gin.Context) {
@@ -101,66 +104,101 @@ func SetupHttpRoute(e *gin.Engine) {
 	// Node management API (public endpoints)
 	e.GET("/nodes", nodes.GetNodes)
 	e.GET("/nodes/current", nodes.GetNodeConfig)
+	e.GET("/nodes/health", nodes.GetNodesHealth)
 	e.GET("/nodes/latency", nodes.TestLatency)
 	
 	// Node management API (admin endpoints with API key authentication)
 	admin := e.Group("/api/admin")
 	admin.Use(nodes.RequireApiKey)
 	{
-		admin.POST("/nodes", nodes.CreateNode)
-		admin.GET("/nodes/add", nodes.CreateNode)     // GET endpoint for easy automation
-		admin.GET("/nodes/:id", nodes.GetNodeDetail)
-		admin.PUT("/nodes/:id", nodes.UpdateNode)
-		admin.DELETE("/nodes/:id", nodes.DeleteNode)
+		nodesWrite := nodes.RequireScope(nodes.ScopeNodesWrite)
+		admin.POST("/nodes", nodesWrite, nodes.CreateNode)
+		admin.GET("/nodes/add", nodesWrite, nodes.CreateNode)     // GET endpoint for easy automation
+		admin.GET("/nodes/export", nodes.RequireScope(nodes.ScopeRead), nodes.ExportNodes)
+		admin.POST("/nodes/import", nodesWrite, nodes.ImportNodes)
+		admin.GET("/nodes/deleted", nodes.RequireScope(nodes.ScopeRead), nodes.GetDeletedNodes)
+		admin.PUT("/nodes/:id/state", nodesWrite, nodes.SetNodeState)
+		admin.POST("/nodes/:id/restore", nodesWrite, nodes.RestoreNode)
+		admin.GET("/nodes/:id", nodes.RequireScope(nodes.ScopeRead), nodes.GetNodeDetail)
+		admin.PUT("/nodes/:id", nodesWrite, nodes.UpdateNode)
+		admin.DELETE("/nodes/:id", nodesWrite, nodes.DeleteNode)
+		admin.POST("/config/reload", nodes.RequireScope(nodes.ScopeConfigWrite), handleReloadConfig)
+		admin.GET("/queue", nodes.RequireScope(nodes.ScopeRead), queue.GetJobs)
+		admin.DELETE("/queue/:id", nodes.RequireScope(nodes.ScopeQueueWrite), queue.CancelJob)
+
+		// API tokens can only be managed with ADMIN_API_KEY
+		admin.GET("/tokens", nodes.RequireMasterKey, nodes.GetTokens)
+		admin.POST("/tokens", nodes.RequireMasterKey, nodes.CreateToken)
+		admin.DELETE("/tokens/:id", nodes.RequireMasterKey, nodes.DeleteToken)
 	}
 	
+	// Routes are always registered and gated per request, so features can be
+	// toggled by a config reload
+	e.GET("/capabilities", handleCapabilities)
+
 	v1 := e.Group("/method", controller.MiddlewareSessionOnHeader())
 	{
-		if config.Config.FeatureIperf3 {
-			v1.GET("/iperf3/server", iperf3.Handle)
-		}
+		v1.GET("/iperf3/server", ratelimit.Job("iperf3"), featureGate("iperf3"), iperf3.Handle)
 
-		if config.Config.FeaturePing {
-			v1.GET("/ping", ping.Handle)
-			v1.GET("/ping6", ping.HandlePing6)
-		}
+		// ?node=<id> runs the tool on another registered node
+		v1.GET("/ping", ratelimit.Job("ping"), federation.Proxy("ping"), featureGate("ping"), ping.Handle)
+		v1.GET("/ping6", ratelimit.Job("ping6"), federation.Proxy("ping6"), featureGate("ping6"), ping.HandlePing6)
+		v1.GET("/tcping", ratelimit.Job("tcping"), federation.Proxy("tcping"), featureGate("tcping"), ping.HandleTCPing)
+		v1.GET("/udping", ratelimit.Job("udping"), federation.Proxy("udping"), featureGate("udping"), ping.HandleUDPing)
+		v1.GET("/httping", ratelimit.Job("httping"), federation.Proxy("httping"), featureGate("httping"), ping.HandleHTTPing)
 
-		if config.Config.FeatureMTR {
-			v1.GET("/mtr", nettools.HandleNetworkTool("mtr"))
-			v1.GET("/mtr6", nettools.HandleNetworkTool("mtr6"))
-		}
+		v1.GET("/mtr", ratelimit.Job("mtr"), federation.Proxy("mtr"), featureGate("mtr"), nettools.HandleNetworkTool("mtr"))
+		v1.GET("/mtr6", ratelimit.Job("mtr6"), federation.Proxy("mtr6"), featureGate("mtr6"), nettools.HandleNetworkTool("mtr6"))
 
-		if config.Config.FeatureTraceroute {
-			v1.GET("/traceroute", nettools.HandleNetworkTool("traceroute"))
-			v1.GET("/traceroute6", nettools.HandleNetworkTool("traceroute6"))
-		}
+		v1.GET("/traceroute", ratelimit.Job("traceroute"), federation.Proxy("traceroute"), featureGate("traceroute"), nettools.HandleNetworkTool("traceroute"))
+		v1.GET("/traceroute6", ratelimit.Job("traceroute6"), federation.Proxy("traceroute6"), featureGate("traceroute6"), nettools.HandleNetworkTool("traceroute6"))
 
-		if config.Config.FeatureSpeedtestDotNet {
-			v1.GET("/speedtest_dot_net", speedtest.HandleSpeedtestDotNet)
-		}
+		// Runs a tool against one target from every matching registered node
+		v1.GET("/fanout/:method", ratelimit.Requests("fanout"), federation.HandleFanout)
 
-		if config.Config.FeatureIfaceTraffic {
-			v1.GET("/cache/interfaces", cache.UpdateInterfaceCache)
-		}
+		v1.GET("/speedtest_dot_net", ratelimit.Job("speedtest_dot_net"), featureGate("speedtest_dot_net"), speedtest.HandleSpeedtestDotNet)
+
+		v1.GET("/cache/interfaces", featureGate("iface_traffic"), cache.UpdateInterfaceCache)
+	}
+
+	// Tools run on behalf of a front node, see federation.Proxy
+	federated := e.Group("/api/federation", nodes.RequireApiKey, nodes.RequireScope(nodes.ScopeFederation))
+	{
+		federated.GET("/session", session.Handle)
+
+		method := federated.Group("/method", controller.MiddlewareSessionOnHeader())
+		method.GET("/ping", featureGate("ping"), ping.Handle)
+		method.GET("/ping6", featureGate("ping6"), ping.HandlePing6)
+		method.GET("/tcping", featureGate("tcping"), ping.HandleTCPing)
+		method.GET("/udping", featureGate("udping"), ping.HandleUDPing)
+		method.GET("/httping", featureGate("httping"), ping.HandleHTTPing)
+		method.GET("/mtr", featureGate("mtr"), nettools.HandleNetworkTool("mtr"))
+		method.GET("/mtr6", featureGate("mtr6"), nettools.HandleNetworkTool("mtr6"))
+		method.GET("/traceroute", featureGate("traceroute"), nettools.HandleNetworkTool("traceroute"))
+		method.GET("/traceroute6", featureGate("traceroute6"), nettools.HandleNetworkTool("traceroute6"))
+	}
+
+	// Agents behind NAT dial in here and receive jobs through the tunnel
+	e.GET("/api/agent/connect", nodes.RequireApiKey, nodes.RequireScope(nodes.ScopeAgent), federation.HandleAgentConnect)
+
+	// Nodes register themselves and report they are alive
+	enroll := e.Group("/api/enroll", nodes.RequireApiKey, nodes.RequireScope(nodes.ScopeEnroll))
+	{
+		enroll.POST("", nodes.EnrollNode)
+		enroll.POST("/:id/heartbeat", nodes.Heartbeat)
 	}
 
 	session := e.Group("/session/:session", controller.MiddlewareSessionOnUrl())
 	{
-		if config.Config.FeatureShell {
-			session.GET("/shell", shell.HandleNewShell)
-		}
+		session.GET("/shell", ratelimit.Requests("shell"), featureGate("shell"), shell.HandleNewShell)
 	}
 
 	speedtestRoute := session.Group("/speedtest", controller.MiddlewareSessionOnUrl())
 	{
-		if config.Config.FeatureFileSpeedtest {
-			speedtestRoute.GET("/file/:filename", speedtest.HandleFakeFile)
-		}
+		speedtestRoute.GET("/file/:filename", ratelimit.Job("file_speedtest"), featureGate("file_speedtest"), speedtest.HandleFakeFile)
 
-		if config.Config.FeatureLibrespeed {
-			speedtestRoute.GET("/download", speedtest.HandleDownload)
-			speedtestRoute.POST("/upload", speedtest.HandleUpload)
-		}
+		speedtestRoute.GET("/download", ratelimit.Requests("librespeed"), featureGate("librespeed"), speedtest.HandleDownload)
+		speedtestRoute.POST("/upload", ratelimit.Requests("librespeed"), featureGate("librespeed"), speedtest.HandleUpload)
 	}
 
 	e.Any("/assets/:filename", func(c *gin.Context) {
@@ -222,15 +260,15 @@ func handleIndexHTML(c *gin.Context) {
 	htmlContent := string(htmlBytes)
 	
 	// 注入动态标题和favicon
-	if config.Config.Location != "" {
-		title := config.Config.Location
+	if config.Get().Location != "" {
+		title := config.Get().Location
 		htmlContent = strings.Replace(htmlContent, "<title>Looking glass server</title>", 
 			fmt.Sprintf("<title>%s</title>", title), 1)
 	}
 	
 	// 注入favicon
-	if config.Config.Logo != "" && (config.Config.LogoType == "url" || config.Config.LogoType == "base64") {
-		faviconLink := fmt.Sprintf(`<link rel="icon" href="%s">`, config.Config.Logo)
+	if config.Get().Logo != "" && (config.Get().LogoType == "url" || config.Get().LogoType == "base64") {
+		faviconLink := fmt.Sprintf(`<link rel="icon" href="%s">`, config.Get().Logo)
 		htmlContent = strings.Replace(htmlContent, `<link rel="icon" href="/favicon.ico">`, faviconLink, 1)
 	}
 	
@@ -240,16 +278,16 @@ func handleIndexHTML(c *gin.Context) {
 
 func handleFavicon(c *gin.Context) {
 	// 如果配置了URL类型的logo，重定向到该URL
-	if config.Config.Logo != "" && config.Config.LogoType == "url" {
-		c.Redirect(302, config.Config.Logo)
+	if config.Get().Logo != "" && config.Get().LogoType == "url" {
+		c.Redirect(302, config.Get().Logo)
 		return
 	}
 	
 	// 如果配置了base64类型的logo，直接返回数据
-	if config.Config.Logo != "" && config.Config.LogoType == "base64" {
+	if config.Get().Logo != "" && config.Get().LogoType == "base64" {
 		// 解析data URL获取MIME类型和数据
-		if strings.HasPrefix(config.Config.Logo, "data:") {
-			parts := strings.Split(config.Config.Logo, ",")
+		if strings.HasPrefix(config.Get().Logo, "data:") {
+			parts := strings.Split(config.Get().Logo, ",")
 			if len(parts) == 2 {
 				// 解析MIME类型
 				mimeType := "image/png" // 默认类型
@@ -271,11 +309,11 @@ func handleFavicon(c *gin.Context) {
 	}
 	
 	// 如果配置了自定义logo且为emoji类型，生成emoji favicon
-	if config.Config.Logo != "" && config.Config.LogoType == "emoji" {
+	if config.Get().Logo != "" && config.Get().LogoType == "emoji" {
 		// 生成简单的emoji SVG favicon
 		svgContent := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 32 32">
 			<text y="24" font-size="24">%s</text>
-		</svg>`, config.Config.Logo)
+		</svg>`, config.Get().Logo)
 		
 		c.Header("Content-Type", "image/svg+xml")
 		c.String(200, svgContent)
@@ -283,9 +321,9 @@ func handleFavicon(c *gin.Context) {
 	}
 	
 	// 如果配置了SVG logo，将其作为favicon
-	if config.Config.Logo != "" && config.Config.LogoType == "svg" {
+	if config.Get().Logo != "" && config.Get().LogoType == "svg" {
 		c.Header("Content-Type", "image/svg+xml")
-		c.String(200, config.Config.Logo)
+		c.String(200, config.Get().Logo)
 		return
 	}
 	
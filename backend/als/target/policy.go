@@ -0,0 +1,191 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/X-Zero-L/als/config"
+)
+
+// reservedNetwork is a network tools may not be run against unless the
+// operator allows it
+type reservedNetwork struct {
+	network *net.IPNet
+	reason  string
+}
+
+var reservedNetworks = func() []reservedNetwork {
+	entries := []struct{ cidr, reason string }{
+		{"0.0.0.0/8", "this network"},
+		{"10.0.0.0/8", "private network"},
+		{"100.64.0.0/10", "carrier-grade NAT"},
+		{"127.0.0.0/8", "loopback"},
+		{"169.254.0.0/16", "link-local"},
+		{"172.16.0.0/12", "private network"},
+		{"192.0.0.0/24", "IETF protocol assignments"},
+		{"192.0.2.0/24", "documentation"},
+		{"192.168.0.0/16", "private network"},
+		{"198.18.0.0/15", "benchmarking"},
+		{"198.51.100.0/24", "documentation"},
+		{"203.0.113.0/24", "documentation"},
+		{"224.0.0.0/4", "multicast"},
+		{"240.0.0.0/4", "reserved"},
+		{"::/128", "unspecified"},
+		{"::1/128", "loopback"},
+		{"100::/64", "discard"},
+		{"2001:db8::/32", "documentation"},
+		{"fc00::/7", "unique local"},
+		{"fe80::/10", "link-local"},
+		{"fec0::/10", "site-local"},
+		{"ff00::/8", "multicast"},
+	}
+
+	networks := make([]reservedNetwork, 0, len(entries))
+	for _, entry := range entries {
+		_, network, _ := net.ParseCIDR(entry.cidr)
+		networks = append(networks, reservedNetwork{network, entry.reason})
+	}
+	return networks
+}()
+
+// BlockedError is returned for targets the policy does not allow
+type BlockedError struct {
+	Target string
+	IP     net.IP
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	if e.Target != e.IP.String() {
+		return fmt.Sprintf("target %s (%s) is not allowed: %s", e.Target, e.IP, e.Reason)
+	}
+	return fmt.Sprintf("target %s is not allowed: %s", e.Target, e.Reason)
+}
+
+// Allowed reports whether tools may be run against ip, and the reason if not
+func Allowed(ip net.IP) (bool, string) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	policy := config.Get().TargetPolicy
+	for _, network := range config.ParseNetworks(policy.Allow) {
+		if network.Contains(ip) {
+			return true, ""
+		}
+	}
+	for _, network := range config.ParseNetworks(policy.Deny) {
+		if network.Contains(ip) {
+			return false, "denied by the operator"
+		}
+	}
+	for _, reserved := range reservedNetworks {
+		if reserved.network.Contains(ip) {
+			return false, reserved.reason
+		}
+	}
+	return true, ""
+}
+
+var numericHost = regexp.MustCompile(`^(0[xX][0-9a-fA-F]+|[0-9]+)(\.(0[xX][0-9a-fA-F]+|[0-9]+)){0,3}$`)
+
+// CheckArgs checks the targets in the arguments of a command typed into the
+// fake shell and returns the arguments to run it with. Flags are skipped,
+// small numbers are taken as flag values and other arguments that look like
+// an address must be allowed. Host names that resolve are replaced by the
+// address chosen for them like Resolve does, -4 or -6 picking the family, so
+// the command cannot resolve them again to somewhere else. Hosts that do not
+// resolve are left to the command to reject.
+func CheckArgs(ctx context.Context, args []string) ([]string, error) {
+	family := FamilyAuto
+	for _, arg := range args {
+		switch arg {
+		case "-4":
+			family = FamilyIPv4
+		case "-6":
+			family = FamilyIPv6
+		}
+	}
+
+	checked := make([]string, len(args))
+	copy(checked, args)
+	for i, arg := range args {
+		if arg == "" || strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		// Scoped addresses such as fe80::1%eth0 are checked without the zone
+		host, _, _ := strings.Cut(arg, "%")
+		if ip := net.ParseIP(host); ip != nil {
+			if ok, reason := Allowed(ip); !ok {
+				return nil, &BlockedError{Target: arg, IP: ip, Reason: reason}
+			}
+			continue
+		}
+		if host != arg {
+			return nil, fmt.Errorf("%s is not a valid address", arg)
+		}
+
+		// inet_aton also accepts forms such as 10.1, 0x7f000001 or 167772161
+		if numericHost.MatchString(arg) {
+			ip, ok := parseNumericIPv4(arg)
+			if !ok {
+				continue
+			}
+			if n, err := strconv.Atoi(arg); err == nil && n > 0 && n <= 65535 {
+				continue
+			}
+			if ok, reason := Allowed(ip); !ok {
+				return nil, &BlockedError{Target: arg, IP: ip, Reason: reason}
+			}
+			continue
+		}
+
+		found, err := lookup(ctx, arg)
+		if err != nil {
+			continue
+		}
+		resolution, err := choose(arg, family, found)
+		if err != nil {
+			return nil, err
+		}
+		checked[i] = resolution.Address
+	}
+	return checked, nil
+}
+
+// parseNumericIPv4 parses the numeric address forms of inet_aton, where the
+// last part fills the remaining bytes
+func parseNumericIPv4(s string) (net.IP, bool) {
+	parts := strings.Split(s, ".")
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 0, 32)
+		if err != nil {
+			return nil, false
+		}
+		values[i] = v
+	}
+
+	last := values[len(values)-1]
+	if last >= 1<<(8*(5-len(values))) {
+		return nil, false
+	}
+
+	var addr uint64
+	for _, v := range values[:len(values)-1] {
+		if v > 255 {
+			return nil, false
+		}
+		addr = addr<<8 | v
+	}
+	addr = addr<<(8*(5-len(values))) | last
+	if addr > 0xffffffff {
+		return nil, false
+	}
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr)), true
+}
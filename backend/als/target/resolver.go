@@ -0,0 +1,247 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/X-Zero-L/als/config"
+	"github.com/miekg/dns"
+)
+
+// Address families a target can be resolved to
+const (
+	FamilyIPv4 = "4"
+	FamilyIPv6 = "6"
+	FamilyAuto = "auto"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+const (
+	resolveTimeout = 5 * time.Second
+	dnsTimeout     = 3 * time.Second
+)
+
+// Resolution is the outcome of resolving a target, as sent in the Resolved
+// event before a tool starts
+type Resolution struct {
+	Target    string   `json:"target"`
+	Family    string   `json:"family"`
+	Addresses []string `json:"addresses"` // every address of the target
+	Address   string   `json:"address"`   // the one the tool runs against
+	Resolver  string   `json:"resolver"`  // DNS server that answered, "system" or "literal"
+	TTL       *uint32  `json:"ttl,omitempty"`
+}
+
+// lookupResult holds the addresses of a host and where they came from
+type lookupResult struct {
+	ips      []net.IP
+	resolver string
+	ttl      *uint32
+}
+
+// Resolve looks up the A and AAAA records of host and picks the address of
+// family a tool should run against, the first one the target policy allows.
+// With FamilyAuto IPv6 is preferred when this node has IPv6 connectivity,
+// alternating between both families like Happy Eyeballs. Tools must be given
+// the chosen address rather than host, so a second lookup cannot lead
+// elsewhere.
+func Resolve(ctx context.Context, host string, family string) (*Resolution, error) {
+	if family != FamilyIPv4 && family != FamilyIPv6 && family != FamilyAuto {
+		return nil, fmt.Errorf("invalid family %q, expected %s, %s or %s", family, FamilyIPv4, FamilyIPv6, FamilyAuto)
+	}
+
+	found, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return choose(host, family, found)
+}
+
+// choose picks the address of family a tool should run against from the
+// addresses host was found at
+func choose(host string, family string, found *lookupResult) (*Resolution, error) {
+	resolution := &Resolution{
+		Target:    host,
+		Family:    family,
+		Addresses: make([]string, 0, len(found.ips)),
+		Resolver:  found.resolver,
+		TTL:       found.ttl,
+	}
+	for _, ip := range found.ips {
+		resolution.Addresses = append(resolution.Addresses, ip.String())
+	}
+
+	candidates := orderCandidates(found.ips, family)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%s has no %s address", host, familyName(family))
+	}
+
+	var blocked error
+	for _, ip := range candidates {
+		ok, reason := Allowed(ip)
+		if ok {
+			resolution.Address = ip.String()
+			return resolution, nil
+		}
+		if blocked == nil {
+			blocked = &BlockedError{Target: host, IP: ip, Reason: reason}
+		}
+	}
+	return nil, blocked
+}
+
+// orderCandidates returns the addresses of family in the order they should
+// be tried
+func orderCandidates(ips []net.IP, family string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch family {
+	case FamilyIPv4:
+		return v4
+	case FamilyIPv6:
+		return v6
+	}
+
+	first, second := v6, v4
+	if config.Get().PublicIPv6 == "" {
+		first, second = v4, v6
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// lookup returns every address of host. The DNS servers of the system are
+// asked directly to learn the TTL, the system resolver is the fallback for
+// names only it knows, such as those in /etc/hosts.
+func lookup(ctx context.Context, host string) (*lookupResult, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return &lookupResult{ips: []net.IP{ip}, resolver: "literal"}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	// Leave time for the fallback when the name servers do not answer
+	dnsCtx, dnsCancel := context.WithTimeout(ctx, dnsTimeout)
+	found := lookupDNS(dnsCtx, host)
+	dnsCancel()
+	if found != nil {
+		return found, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return nil, fmt.Errorf("failed to resolve %s", host)
+	}
+	found = &lookupResult{resolver: "system"}
+	for _, addr := range addrs {
+		found.ips = append(found.ips, addr.IP)
+	}
+	return found, nil
+}
+
+// lookupDNS asks the name servers of resolv.conf for the A and AAAA records
+// of host, it returns nil if none of them had an answer
+func lookupDNS(ctx context.Context, host string) *lookupResult {
+	conf, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil || len(conf.Servers) == 0 {
+		return nil
+	}
+
+	client := &dns.Client{Timeout: 2 * time.Second}
+	for _, name := range conf.NameList(host) {
+		for _, server := range conf.Servers {
+			address := net.JoinHostPort(server, conf.Port)
+			found, ok := queryServer(ctx, client, address, name)
+			if !ok {
+				// The server failed, ask the next one
+				continue
+			}
+			if found != nil {
+				return found
+			}
+			// The name does not exist, try the next search domain
+			break
+		}
+	}
+	return nil
+}
+
+// queryServer asks server for the A and AAAA records of name at the same
+// time. It reports false if the server could not answer.
+func queryServer(ctx context.Context, client *dns.Client, server string, name string) (*lookupResult, bool) {
+	types := []uint16{dns.TypeA, dns.TypeAAAA}
+	answers := make([]*dns.Msg, len(types))
+	errs := make([]error, len(types))
+
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			m := new(dns.Msg)
+			m.SetQuestion(name, qtype)
+			answers[i], _, errs[i] = client.ExchangeContext(ctx, m, server)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	found := &lookupResult{resolver: server}
+	for i, answer := range answers {
+		if errs[i] != nil || answer == nil {
+			return nil, false
+		}
+		if answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError {
+			return nil, false
+		}
+
+		for _, record := range answer.Answer {
+			switch r := record.(type) {
+			case *dns.A:
+				found.ips = append(found.ips, r.A)
+			case *dns.AAAA:
+				found.ips = append(found.ips, r.AAAA)
+			case *dns.CNAME:
+			default:
+				continue
+			}
+			if ttl := record.Header().Ttl; found.ttl == nil || ttl < *found.ttl {
+				found.ttl = &ttl
+			}
+		}
+	}
+
+	if len(found.ips) == 0 {
+		return nil, true
+	}
+	return found, true
+}
+
+func familyName(family string) string {
+	switch family {
+	case FamilyIPv4:
+		return "IPv4"
+	case FamilyIPv6:
+		return "IPv6"
+	}
+	return "IP"
+}
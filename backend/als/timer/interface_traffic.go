@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/X-Zero-L/als/als/client"
+	"github.com/X-Zero-L/als/config"
 	"github.com/vishvananda/netlink"
 )
 
@@ -24,6 +25,9 @@ func SetupInterfaceBroadcast() {
 	ticker := time.NewTicker(1 * time.Second)
 	for {
 		<-ticker.C
+		if !config.Get().FeatureIfaceTraffic {
+			continue
+		}
 		interfaces, err := net.Interfaces()
 		if err != nil {
 			continue
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Capability describes an external binary used by a tool
+type Capability struct {
+	Available bool   `json:"available"`
+	Path      string `json:"-"`
+	Version   string `json:"version,omitempty"`
+}
+
+// capabilityProbe describes how to find and query the version of a binary.
+// Candidates are tried in order, the first one found wins.
+type capabilityProbe struct {
+	name       string
+	candidates [][]string // binary followed by the arguments printing its version
+}
+
+var capabilityProbes = []capabilityProbe{
+	{"mtr", [][]string{{"mtr", "--version"}}},
+	{"traceroute", [][]string{{"traceroute", "--version"}}},
+	{"traceroute6", [][]string{{"traceroute6", "--version"}}},
+	{"speedtest", [][]string{{"speedtest", "--version"}}},
+	{"iperf3", [][]string{{"iperf3", "--version"}}},
+}
+
+// ProbeCapabilities looks up every external binary and queries its version
+func ProbeCapabilities() map[string]Capability {
+	capabilities := make(map[string]Capability, len(capabilityProbes))
+	for _, probe := range capabilityProbes {
+		capability := Capability{}
+		for _, candidate := range probe.candidates {
+			path, err := exec.LookPath(candidate[0])
+			if err != nil {
+				continue
+			}
+			capability = Capability{
+				Available: true,
+				Path:      path,
+				Version:   binaryVersion(path, candidate[1:]...),
+			}
+			break
+		}
+		capabilities[probe.name] = capability
+	}
+	return capabilities
+}
+
+// binaryVersion returns the first line printed by the version command, empty
+// if it cannot be run
+func binaryVersion(path string, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Some tools exit non-zero after printing their version, only the output matters
+	output, _ := exec.CommandContext(ctx, path, args...).CombinedOutput()
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			if len(line) > 200 {
+				line = line[:200]
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// HasCapability reports whether the binary name was found at startup or on
+// the last config reload
+func (cfg *ALSConfig) HasCapability(name string) bool {
+	return cfg.Capabilities[name].Available
+}
+
+// applyCapabilities disables the features whose binaries are all missing
+func applyCapabilities(cfg *ALSConfig) {
+	disable := func(feature *bool, name string, binaries ...string) {
+		if !*feature {
+			return
+		}
+		for _, binary := range binaries {
+			if cfg.HasCapability(binary) {
+				return
+			}
+		}
+		log.Default().Printf("WARN: Disable %s due to %s not found", name, strings.Join(binaries, "/"))
+		*feature = false
+	}
+
+	disable(&cfg.FeatureMTR, "mtr", "mtr")
+	disable(&cfg.FeatureTraceroute, "traceroute", "traceroute", "traceroute6")
+	disable(&cfg.FeatureSpeedtestDotNet, "speedtest.net", "speedtest")
+	disable(&cfg.FeatureIperf3, "iperf3", "iperf3")
+}
+
+// AdvertisedMetadata describes what this node can do, as announced to a
+// controller by agents and enrolled nodes
+func (cfg *ALSConfig) AdvertisedMetadata() NodeMetadata {
+	var features []string
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"ping", cfg.FeaturePing},
+		{"mtr", cfg.FeatureMTR},
+		{"traceroute", cfg.FeatureTraceroute},
+		{"iperf3", cfg.FeatureIperf3},
+		{"speedtest", cfg.FeatureSpeedtestDotNet},
+		{"librespeed", cfg.FeatureLibrespeed},
+		{"filespeedtest", cfg.FeatureFileSpeedtest},
+		{"shell", cfg.FeatureShell},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+
+	// Public IPs are detected in the background, only claim what is known
+	metadata := NodeMetadata{Features: features}
+	known := true
+	if cfg.PublicIPv4 != "" {
+		metadata.IPv4 = &known
+	}
+	if cfg.PublicIPv6 != "" {
+		metadata.IPv6 = &known
+	}
+	return metadata
+}
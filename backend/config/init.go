@@ -1,53 +1,143 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var Config *ALSConfig
 var IsInternalCall bool
 
+// current is the config in effect, replaced as a whole so handlers can read
+// it while it is reloaded
+var current atomic.Pointer[ALSConfig]
+
+// updateMu serializes the writers of current
+var updateMu sync.Mutex
+
+// Get returns the config in effect. It is shared and must not be modified,
+// changes go through update.
+func Get() *ALSConfig {
+	return current.Load()
+}
+
+// update publishes a copy of the config with change applied
+func update(change func(cfg *ALSConfig)) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	cfg := *current.Load()
+	change(&cfg)
+	current.Store(&cfg)
+}
+
 type ALSConfig struct {
-	ListenHost string `json:"-"`
-	ListenPort string `json:"-"`
+	ListenHost string `json:"-" yaml:"listen_host" toml:"listen_host"`
+	ListenPort string `json:"-" yaml:"listen_port" toml:"listen_port"`
 
-	Location string `json:"location"`
-	Logo     string `json:"logo"`
-	LogoType string `json:"logo_type"`
+	Location string `json:"location" yaml:"location" toml:"location"`
+	Logo     string `json:"logo" yaml:"logo" toml:"logo"`
+	LogoType string `json:"logo_type" yaml:"logo_type" toml:"logo_type"`
 
-	PublicIPv4 string `json:"public_ipv4"`
-	PublicIPv6 string `json:"public_ipv6"`
+	PublicIPv4 string `json:"public_ipv4" yaml:"public_ipv4" toml:"public_ipv4"`
+	PublicIPv6 string `json:"public_ipv6" yaml:"public_ipv6" toml:"public_ipv6"`
 
 	// Network information
-	BGP string `json:"bgp"`
-	ASN string `json:"asn"`
-
-	Iperf3StartPort int `json:"-"`
-	Iperf3EndPort   int `json:"-"`
-
-	SpeedtestFileList []string `json:"speedtest_files"`
-
-	SponsorMessage     string `json:"sponsor_message"`
-	SponsorMessageType string `json:"sponsor_message_type"`
-
-	FeaturePing            bool `json:"feature_ping"`
-	FeatureShell           bool `json:"feature_shell"`
-	FeatureLibrespeed      bool `json:"feature_librespeed"`
-	FeatureFileSpeedtest   bool `json:"feature_filespeedtest"`
-	FeatureSpeedtestDotNet bool `json:"feature_speedtest_dot_net"`
-	FeatureIperf3          bool `json:"feature_iperf3"`
-	FeatureMTR             bool `json:"feature_mtr"`
-	FeatureTraceroute      bool `json:"feature_traceroute"`
-	FeatureIfaceTraffic    bool `json:"feature_iface_traffic"`
+	BGP string `json:"bgp" yaml:"bgp" toml:"bgp"`
+	ASN string `json:"asn" yaml:"asn" toml:"asn"`
+
+	Iperf3StartPort int `json:"-" yaml:"iperf3_port_min" toml:"iperf3_port_min"`
+	Iperf3EndPort   int `json:"-" yaml:"iperf3_port_max" toml:"iperf3_port_max"`
+
+	SpeedtestFileList []string `json:"speedtest_files" yaml:"speedtest_files" toml:"speedtest_files"`
+
+	SponsorMessage     string `json:"sponsor_message" yaml:"sponsor_message" toml:"sponsor_message"`
+	SponsorMessageType string `json:"sponsor_message_type" yaml:"-" toml:"-"`
+
+	// Tool tunables
+	ToolTimeout int        `json:"-" yaml:"tool_timeout" toml:"tool_timeout"` // in seconds
+	Ping        ToolConfig `json:"ping" yaml:"ping" toml:"ping"`
+	MTR         ToolConfig `json:"mtr" yaml:"mtr" toml:"mtr"`
+	Traceroute  ToolConfig `json:"traceroute" yaml:"traceroute" toml:"traceroute"`
+	Speedtest   ToolConfig `json:"-" yaml:"speedtest" toml:"speedtest"`
+
+	// Deprecated file keys of ping.count and mtr.count, see applyDeprecatedKeys
+	DeprecatedPingCount       *int `json:"-" yaml:"ping_count" toml:"ping_count"`
+	DeprecatedMTRReportCycles *int `json:"-" yaml:"mtr_report_cycles" toml:"mtr_report_cycles"`
+
+	// Concurrency limits of the resource pools
+	Queue QueueConfig `json:"-" yaml:"queue" toml:"queue"`
+
+	// Per client IP limits
+	RateLimit RateLimitConfig `json:"-" yaml:"rate_limit" toml:"rate_limit"`
+
+	// Networks tools may or may not be run against
+	TargetPolicy TargetPolicyConfig `json:"-" yaml:"target_policy" toml:"target_policy"`
+
+	// Node management
+	AdminApiKey         string       `json:"-" yaml:"admin_api_key" toml:"admin_api_key"`
+	DataDir             string       `json:"-" yaml:"data_dir" toml:"data_dir"`
+	NodeStorage         string       `json:"-" yaml:"node_storage" toml:"node_storage"` // file or sqlite
+	CurrentNodeName     string       `json:"-" yaml:"current_node_name" toml:"current_node_name"`
+	CurrentNodeLocation string       `json:"-" yaml:"current_node_location" toml:"current_node_location"`
+	CurrentNodeURL      string       `json:"-" yaml:"current_node_url" toml:"current_node_url"`
+	Nodes               []NodeConfig `json:"-" yaml:"nodes" toml:"nodes"`
+	NodeHealthInterval  int          `json:"-" yaml:"node_health_interval" toml:"node_health_interval"` // in seconds, 0 disables
+	NodeHealthTimeout   int          `json:"-" yaml:"node_health_timeout" toml:"node_health_timeout"`   // in seconds
+	NodeStaleAfter      int          `json:"-" yaml:"node_stale_after" toml:"node_stale_after"`         // in seconds without heartbeat
+	NodeExpireAfter     int          `json:"-" yaml:"node_expire_after" toml:"node_expire_after"`       // in seconds without heartbeat, 0 disables
+
+	// Agent mode: dial out to a controller instead of waiting for requests
+	AgentControllerURL string `json:"-" yaml:"agent_controller_url" toml:"agent_controller_url"`
+	AgentToken         string `json:"-" yaml:"agent_token" toml:"agent_token"` // token with the agent scope
+
+	// Enrollment: register this node into a controller and keep it alive
+	ControllerURL     string `json:"-" yaml:"controller_url" toml:"controller_url"`
+	EnrollmentToken   string `json:"-" yaml:"enrollment_token" toml:"enrollment_token"`     // token with the enroll scope
+	HeartbeatInterval int    `json:"-" yaml:"heartbeat_interval" toml:"heartbeat_interval"` // in seconds
+
+	// External binaries found at startup, filled in by LoadWebConfig
+	Capabilities map[string]Capability `json:"-" yaml:"-" toml:"-"`
+
+	FeaturePing            bool `json:"feature_ping" yaml:"feature_ping" toml:"feature_ping"`
+	FeatureShell           bool `json:"feature_shell" yaml:"feature_shell" toml:"feature_shell"`
+	FeatureLibrespeed      bool `json:"feature_librespeed" yaml:"feature_librespeed" toml:"feature_librespeed"`
+	FeatureFileSpeedtest   bool `json:"feature_filespeedtest" yaml:"feature_filespeedtest" toml:"feature_filespeedtest"`
+	FeatureSpeedtestDotNet bool `json:"feature_speedtest_dot_net" yaml:"feature_speedtest_dot_net" toml:"feature_speedtest_dot_net"`
+	FeatureIperf3          bool `json:"feature_iperf3" yaml:"feature_iperf3" toml:"feature_iperf3"`
+	FeatureMTR             bool `json:"feature_mtr" yaml:"feature_mtr" toml:"feature_mtr"`
+	FeatureTraceroute      bool `json:"feature_traceroute" yaml:"feature_traceroute" toml:"feature_traceroute"`
+	FeatureIfaceTraffic    bool `json:"feature_iface_traffic" yaml:"feature_iface_traffic" toml:"feature_iface_traffic"`
+	FeatureFederation      bool `json:"feature_federation" yaml:"feature_federation" toml:"feature_federation"` // run tools on other nodes
+}
+
+// NodeConfig is a statically configured Looking Glass node
+type NodeConfig struct {
+	Name         string `json:"name" yaml:"name" toml:"name"`
+	Location     string `json:"location" yaml:"location" toml:"location"`
+	URL          string `json:"url" yaml:"url" toml:"url"`
+	NodeMetadata `yaml:",inline"`
+}
+
+// NodeMetadata holds the optional descriptive fields of a node
+type NodeMetadata struct {
+	CountryCode string   `json:"country_code,omitempty" yaml:"country_code" toml:"country_code"` // ISO 3166-1 alpha-2
+	Region      string   `json:"region,omitempty" yaml:"region" toml:"region"`                   // continent or region, e.g. "Europe"
+	Provider    string   `json:"provider,omitempty" yaml:"provider" toml:"provider"`
+	ASN         string   `json:"asn,omitempty" yaml:"asn" toml:"asn"`
+	Tags        []string `json:"tags,omitempty" yaml:"tags" toml:"tags"`
+	IPv4        *bool    `json:"ipv4,omitempty" yaml:"ipv4" toml:"ipv4"`
+	IPv6        *bool    `json:"ipv6,omitempty" yaml:"ipv6" toml:"ipv6"`
+	Features    []string `json:"features,omitempty" yaml:"features" toml:"features"` // e.g. "mtr", "iperf3", "speedtest"
 }
 
 func GetDefaultConfig() *ALSConfig {
@@ -66,6 +156,22 @@ func GetDefaultConfig() *ALSConfig {
 		BGP:               "",
 		ASN:               "",
 
+		ToolTimeout: 60,
+		Ping:        defaultPingConfig(),
+		MTR:         defaultMTRConfig(),
+		Traceroute:  defaultTracerouteConfig(),
+		Queue:       defaultQueueConfig(),
+		RateLimit:   defaultRateLimitConfig(),
+
+		DataDir:     "./data",
+		NodeStorage: "file",
+
+		NodeHealthInterval: 60,
+		NodeHealthTimeout:  5,
+		NodeStaleAfter:     90,
+		NodeExpireAfter:    600,
+		HeartbeatInterval:  30,
+
 		FeaturePing:            true,
 		FeatureShell:           true,
 		FeatureLibrespeed:      true,
@@ -80,28 +186,59 @@ func GetDefaultConfig() *ALSConfig {
 	return defaultConfig
 }
 
+// Load builds Config from, in increasing order of precedence, the built-in
+// defaults, the config file (if any) and the environment variables. It exits
+// on the same problems Reload and --check-config reject.
 func Load() {
 	// default config
-	Config = GetDefaultConfig()
-	LoadFromEnv()
+	cfg, problems, err := read()
+	if err != nil {
+		log.Fatalf("Failed to load config file %s: %v", ConfigFile, err)
+	}
+	// The fake shell is started by a server that validated the same config
+	if len(problems) > 0 && !IsInternalCall {
+		for _, problem := range problems {
+			log.Default().Printf("ERROR: Invalid config: %v", problem)
+		}
+		log.Fatalf("Refusing to start with an invalid config, run with --check-config for details")
+	}
+	current.Store(cfg)
 }
 
-func LoadWebConfig() {
-	Load()
-	LoadSponsorMessage()
-	LoadLogoType()
-	log.Default().Println("Loading config for web services...")
+// read builds a fresh config from the defaults, the config file and the
+// environment. A config file that cannot be read is returned as err, invalid
+// values are returned as problems.
+func read() (cfg *ALSConfig, problems []error, err error) {
+	cfg = GetDefaultConfig()
+	if ConfigFile != "" {
+		if err := LoadFromFile(cfg, ConfigFile); err != nil {
+			return cfg, nil, err
+		}
+	}
+	problems = append(problems, LoadFromEnv(cfg)...)
+	problems = append(problems, Validate(cfg)...)
+	return cfg, problems, nil
+}
 
-	_, err := exec.LookPath("iperf3")
+// Check loads the config the same way Load does and returns every problem
+// found, without touching Config
+func Check() []error {
+	_, problems, err := read()
 	if err != nil {
-		log.Default().Println("WARN: Disable iperf3 due to not found")
-		Config.FeatureIperf3 = false
+		return []error{fmt.Errorf("config file %s: %w", ConfigFile, err)}
 	}
+	return problems
+}
+
+func LoadWebConfig() {
+	Load()
+	log.Default().Println("Loading config for web services...")
+	update(prepareWebConfig)
 
-	if Config.PublicIPv4 == "" && Config.PublicIPv6 == "" {
+	if cfg := Get(); cfg.PublicIPv4 == "" && cfg.PublicIPv6 == "" {
 		go func() {
 			updatePublicIP()
-			if Config.Location == "" {
+			if Get().Location == "" {
 				updateLocation()
 			}
 		}()
@@ -109,98 +246,149 @@ func LoadWebConfig() {
 
 }
 
-func LoadSponsorMessage() {
-	if Config.SponsorMessage == "" {
+// prepareWebConfig resolves the sponsor message and logo, and disables
+// features whose binaries are missing
+func prepareWebConfig(cfg *ALSConfig) {
+	LoadSponsorMessage(cfg)
+	LoadLogoType(cfg)
+
+	cfg.Capabilities = ProbeCapabilities()
+	applyCapabilities(cfg)
+}
+
+// Reload re-reads the config file and environment variables and swaps Config.
+// Values detected at runtime (public IPs, BGP info, location) are kept unless
+// the new config sets them explicitly.
+func Reload() error {
+	cfg, problems, err := read()
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.Join(problems...)
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	old := current.Load()
+	if cfg.ListenHost != old.ListenHost || cfg.ListenPort != old.ListenPort || cfg.DataDir != old.DataDir || cfg.NodeStorage != old.NodeStorage || cfg.AgentControllerURL != old.AgentControllerURL || cfg.AgentToken != old.AgentToken || cfg.ControllerURL != old.ControllerURL || cfg.EnrollmentToken != old.EnrollmentToken || !slices.Equal(cfg.RateLimit.TrustedProxies, old.RateLimit.TrustedProxies) {
+		log.Default().Println("WARN: Changes to listen address, data_dir, node_storage, agent, enrollment or trusted proxy settings take effect after restart")
+	}
+	if cfg.PublicIPv4 == "" {
+		cfg.PublicIPv4 = old.PublicIPv4
+	}
+	if cfg.PublicIPv6 == "" {
+		cfg.PublicIPv6 = old.PublicIPv6
+	}
+	if cfg.BGP == "" {
+		cfg.BGP = old.BGP
+	}
+	if cfg.ASN == "" {
+		cfg.ASN = old.ASN
+	}
+	if cfg.Location == "" {
+		cfg.Location = old.Location
+	}
+
+	prepareWebConfig(cfg)
+	current.Store(cfg)
+	log.Default().Println("Config reloaded")
+	return nil
+}
+
+func LoadSponsorMessage(cfg *ALSConfig) {
+	if cfg.SponsorMessage == "" {
 		return
 	}
 
 	log.Default().Println("Loading sponsor message...")
 
-	originalMessage := Config.SponsorMessage
+	originalMessage := cfg.SponsorMessage
 
 	// 检查是否为本地文件路径
-	if _, err := os.Stat(Config.SponsorMessage); err == nil {
-		content, err := os.ReadFile(Config.SponsorMessage)
+	if _, err := os.Stat(cfg.SponsorMessage); err == nil {
+		content, err := os.ReadFile(cfg.SponsorMessage)
 		if err == nil {
-			Config.SponsorMessage = string(content)
+			cfg.SponsorMessage = string(content)
 			// 根据文件扩展名判断类型
 			if strings.HasSuffix(strings.ToLower(originalMessage), ".md") {
-				Config.SponsorMessageType = "markdown"
+				cfg.SponsorMessageType = "markdown"
 			} else if strings.HasSuffix(strings.ToLower(originalMessage), ".html") {
-				Config.SponsorMessageType = "html"
+				cfg.SponsorMessageType = "html"
 			} else {
-				Config.SponsorMessageType = "text"
+				cfg.SponsorMessageType = "text"
 			}
 			return
 		}
 	}
 
 	// 检查是否为URL
-	if strings.HasPrefix(Config.SponsorMessage, "http://") || strings.HasPrefix(Config.SponsorMessage, "https://") {
+	if strings.HasPrefix(cfg.SponsorMessage, "http://") || strings.HasPrefix(cfg.SponsorMessage, "https://") {
 		lowerURL := strings.ToLower(originalMessage)
 		
 		// 如果是.md链接，下载内容作为markdown
 		if strings.HasSuffix(lowerURL, ".md") {
-			resp, err := http.Get(Config.SponsorMessage)
+			resp, err := http.Get(cfg.SponsorMessage)
 			if err == nil {
 				content, err := io.ReadAll(resp.Body)
 				resp.Body.Close()
 				if err == nil {
 					log.Default().Println("Loaded sponsor message from markdown URL.")
-					Config.SponsorMessage = string(content)
-					Config.SponsorMessageType = "markdown"
+					cfg.SponsorMessage = string(content)
+					cfg.SponsorMessageType = "markdown"
 					return
 				}
 			}
 		} else {
 			// 其他URL作为iframe处理
 			log.Default().Println("Using sponsor message as iframe URL.")
-			Config.SponsorMessageType = "iframe"
+			cfg.SponsorMessageType = "iframe"
 			return
 		}
 	}
 
 	// 如果不是文件路径也不是URL，当作纯文本处理
 	// 检测内容类型
-	content := Config.SponsorMessage
+	content := cfg.SponsorMessage
 	if strings.Contains(content, "<") && strings.Contains(content, ">") {
 		// 包含HTML标签，判断为HTML
-		Config.SponsorMessageType = "html"
+		cfg.SponsorMessageType = "html"
 	} else if strings.Contains(content, "#") || strings.Contains(content, "*") || strings.Contains(content, "[") {
 		// 包含Markdown特征，判断为Markdown
-		Config.SponsorMessageType = "markdown"
+		cfg.SponsorMessageType = "markdown"
 	} else {
 		// 纯文本
-		Config.SponsorMessageType = "text"
+		cfg.SponsorMessageType = "text"
 	}
 
-	log.Default().Printf("Sponsor message type detected: %s", Config.SponsorMessageType)
+	log.Default().Printf("Sponsor message type detected: %s", cfg.SponsorMessageType)
 }
 
-func LoadLogoType() {
-	if Config.Logo == "" {
+func LoadLogoType(cfg *ALSConfig) {
+	if cfg.Logo == "" {
 		return
 	}
 
 	// 如果用户已经指定了类型，就不要自动检测
-	if Config.LogoType != "auto" {
+	if cfg.LogoType != "auto" {
 		return
 	}
 
 	log.Default().Println("Detecting logo type...")
 
-	content := Config.Logo
+	content := cfg.Logo
 
 	// 检测是否为URL
 	if strings.HasPrefix(content, "http://") || strings.HasPrefix(content, "https://") {
 		// 尝试获取网站的favicon
 		if faviconURL := fetchFaviconFromURL(content); faviconURL != "" {
-			Config.Logo = faviconURL
-			Config.LogoType = "url"
+			cfg.Logo = faviconURL
+			cfg.LogoType = "url"
 			log.Default().Printf("Logo type detected: url, favicon found: %s", faviconURL)
 		} else {
 			// 如果获取不到favicon，直接使用原URL
-			Config.LogoType = "url"
+			cfg.LogoType = "url"
 			log.Default().Println("Logo type detected: url (direct)")
 		}
 		return
@@ -208,14 +396,14 @@ func LoadLogoType() {
 
 	// 检测是否为base64
 	if strings.HasPrefix(content, "data:image/") {
-		Config.LogoType = "base64"
+		cfg.LogoType = "base64"
 		log.Default().Println("Logo type detected: base64")
 		return
 	}
 
 	// 检测是否为SVG
 	if strings.Contains(content, "<svg") && strings.Contains(content, "</svg>") {
-		Config.LogoType = "svg"
+		cfg.LogoType = "svg"
 		log.Default().Println("Logo type detected: svg")
 		return
 	}
@@ -229,7 +417,7 @@ func LoadLogoType() {
 			   r >= 0x1F680 && r <= 0x1F6FF || // 交通和地图符号
 			   r >= 0x2600 && r <= 0x26FF ||   // 杂项符号
 			   r >= 0x2700 && r <= 0x27BF {    // 装饰符号
-				Config.LogoType = "emoji"
+				cfg.LogoType = "emoji"
 				log.Default().Println("Logo type detected: emoji")
 				return
 			}
@@ -237,7 +425,7 @@ func LoadLogoType() {
 	}
 
 	// 默认当作纯文本处理
-	Config.LogoType = "text"
+	cfg.LogoType = "text"
 	log.Default().Println("Logo type detected: text")
 }
 
@@ -27,7 +27,7 @@ func updatePublicIP() {
 	go func() {
 		addr, err := getPublicIPv4ViaDNS()
 		if err == nil {
-			Config.PublicIPv4 = addr
+			update(func(cfg *ALSConfig) { cfg.PublicIPv4 = addr })
 			log.Printf("Public IPv4 address: %s\n", addr)
 			// Get BGP info for IPv4
 			go updateBGPInfo(addr)
@@ -36,7 +36,7 @@ func updatePublicIP() {
 
 		addr, err = getPublicIPv4ViaHttp()
 		if err == nil {
-			Config.PublicIPv4 = addr
+			update(func(cfg *ALSConfig) { cfg.PublicIPv4 = addr })
 			log.Printf("Public IPv4 address: %s\n", addr)
 			// Get BGP info for IPv4
 			go updateBGPInfo(addr)
@@ -48,7 +48,7 @@ func updatePublicIP() {
 	go func() {
 		addr, err := getPublicIPv6ViaDNS()
 		if err == nil {
-			Config.PublicIPv6 = addr
+			update(func(cfg *ALSConfig) { cfg.PublicIPv6 = addr })
 			log.Printf("Public IPv6 address: %s\n", addr)
 			return
 		}
@@ -66,13 +66,15 @@ func updateBGPInfo(ip string) {
 	}
 	
 	if bgpInfo != nil {
-		Config.ASN = bgpInfo.ASN
+		bgp := bgpInfo.ASN
 		if bgpInfo.ASNName != "" {
-			Config.BGP = fmt.Sprintf("%s (%s)", bgpInfo.ASN, bgpInfo.ASNName)
-		} else {
-			Config.BGP = bgpInfo.ASN
+			bgp = fmt.Sprintf("%s (%s)", bgpInfo.ASN, bgpInfo.ASNName)
 		}
-		log.Printf("BGP Info - ASN: %s, BGP: %s", Config.ASN, Config.BGP)
+		update(func(cfg *ALSConfig) {
+			cfg.ASN = bgpInfo.ASN
+			cfg.BGP = bgp
+		})
+		log.Printf("BGP Info - ASN: %s, BGP: %s", bgpInfo.ASN, bgp)
 	}
 }
 
@@ -1,38 +1,103 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-func LoadFromEnv() {
+// LoadFromEnv applies environment variables on top of cfg. Values that cannot
+// be parsed are skipped and returned as problems.
+func LoadFromEnv(cfg *ALSConfig) []error {
+	var problems []error
+
 	envVarsString := map[string]*string{
-		"LISTEN_IP":       &Config.ListenHost,
-		"HTTP_PORT":       &Config.ListenPort,
-		"LOCATION":        &Config.Location,
-		"LOGO":            &Config.Logo,
-		"LOGO_TYPE":       &Config.LogoType,
-		"PUBLIC_IPV4":     &Config.PublicIPv4,
-		"PUBLIC_IPV6":     &Config.PublicIPv6,
-		"SPONSOR_MESSAGE": &Config.SponsorMessage,
+		"LISTEN_IP":       &cfg.ListenHost,
+		"HTTP_PORT":       &cfg.ListenPort,
+		"LOCATION":        &cfg.Location,
+		"LOGO":            &cfg.Logo,
+		"LOGO_TYPE":       &cfg.LogoType,
+		"PUBLIC_IPV4":     &cfg.PublicIPv4,
+		"PUBLIC_IPV6":     &cfg.PublicIPv6,
+		"SPONSOR_MESSAGE": &cfg.SponsorMessage,
+
+		"ADMIN_API_KEY":       &cfg.AdminApiKey,
+		"DATA_DIR":            &cfg.DataDir,
+		"NODE_STORAGE":        &cfg.NodeStorage,
+		"LG_CURRENT_NAME":     &cfg.CurrentNodeName,
+		"LG_CURRENT_LOCATION": &cfg.CurrentNodeLocation,
+		"LG_CURRENT_URL":      &cfg.CurrentNodeURL,
+
+		"AGENT_CONTROLLER_URL": &cfg.AgentControllerURL,
+		"AGENT_TOKEN":          &cfg.AgentToken,
+
+		"CONTROLLER_URL":   &cfg.ControllerURL,
+		"ENROLLMENT_TOKEN": &cfg.EnrollmentToken,
 	}
 
 	envVarsInt := map[string]*int{
-		"UTILITIES_IPERF3_PORT_MIN": &Config.Iperf3StartPort,
-		"UTILITIES_IPERF3_PORT_MAX": &Config.Iperf3EndPort,
+		"UTILITIES_IPERF3_PORT_MIN": &cfg.Iperf3StartPort,
+		"UTILITIES_IPERF3_PORT_MAX": &cfg.Iperf3EndPort,
+		"UTILITIES_TOOL_TIMEOUT":    &cfg.ToolTimeout,
+		"NODE_HEALTH_INTERVAL":      &cfg.NodeHealthInterval,
+		"NODE_HEALTH_TIMEOUT":       &cfg.NodeHealthTimeout,
+		"NODE_STALE_AFTER":          &cfg.NodeStaleAfter,
+		"NODE_EXPIRE_AFTER":         &cfg.NodeExpireAfter,
+		"HEARTBEAT_INTERVAL":        &cfg.HeartbeatInterval,
+
+		"UTILITIES_PING_COUNT":           &cfg.Ping.Count,
+		"UTILITIES_PING_MAX_COUNT":       &cfg.Ping.MaxCount,
+		"UTILITIES_PING_INTERVAL":        &cfg.Ping.Interval,
+		"UTILITIES_PING_MIN_INTERVAL":    &cfg.Ping.MinInterval,
+		"UTILITIES_PING_MAX_INTERVAL":    &cfg.Ping.MaxInterval,
+		"UTILITIES_PING_PACKET_SIZE":     &cfg.Ping.PacketSize,
+		"UTILITIES_PING_MAX_PACKET_SIZE": &cfg.Ping.MaxPacketSize,
+		"UTILITIES_PING_TIMEOUT":         &cfg.Ping.Timeout,
+
+		"UTILITIES_MTR_CYCLES":          &cfg.MTR.Count,
+		"UTILITIES_MTR_MAX_CYCLES":      &cfg.MTR.MaxCount,
+		"UTILITIES_MTR_INTERVAL":        &cfg.MTR.Interval,
+		"UTILITIES_MTR_MIN_INTERVAL":    &cfg.MTR.MinInterval,
+		"UTILITIES_MTR_MAX_INTERVAL":    &cfg.MTR.MaxInterval,
+		"UTILITIES_MTR_PACKET_SIZE":     &cfg.MTR.PacketSize,
+		"UTILITIES_MTR_MAX_PACKET_SIZE": &cfg.MTR.MaxPacketSize,
+		"UTILITIES_MTR_MAX_HOPS":        &cfg.MTR.MaxHops,
+		"UTILITIES_MTR_MAX_HOPS_LIMIT":  &cfg.MTR.MaxHopsLimit,
+		"UTILITIES_MTR_TIMEOUT":         &cfg.MTR.Timeout,
+
+		"UTILITIES_TRACEROUTE_PACKET_SIZE":     &cfg.Traceroute.PacketSize,
+		"UTILITIES_TRACEROUTE_MAX_PACKET_SIZE": &cfg.Traceroute.MaxPacketSize,
+		"UTILITIES_TRACEROUTE_MAX_HOPS":        &cfg.Traceroute.MaxHops,
+		"UTILITIES_TRACEROUTE_MAX_HOPS_LIMIT":  &cfg.Traceroute.MaxHopsLimit,
+		"UTILITIES_TRACEROUTE_TIMEOUT":         &cfg.Traceroute.Timeout,
+
+		"UTILITIES_SPEEDTESTDOTNET_TIMEOUT": &cfg.Speedtest.Timeout,
+
+		"UTILITIES_QUEUE_SPEEDTEST_CLI": &cfg.Queue.SpeedtestCLI,
+		"UTILITIES_QUEUE_FILE_DOWNLOAD": &cfg.Queue.FileDownload,
+		"UTILITIES_QUEUE_IPERF3":        &cfg.Queue.Iperf3,
+		"UTILITIES_QUEUE_MTR":           &cfg.Queue.MTR,
+		"UTILITIES_QUEUE_TRACEROUTE":    &cfg.Queue.Traceroute,
+		"UTILITIES_QUEUE_MAX_RUN_TIME":  &cfg.Queue.MaxRunTime,
+
+		"RATE_LIMIT_REQUESTS_PER_MINUTE": &cfg.RateLimit.RequestsPerMinute,
+		"RATE_LIMIT_MAX_CONCURRENT_JOBS": &cfg.RateLimit.MaxConcurrentJobs,
+		"RATE_LIMIT_MAX_SESSIONS":        &cfg.RateLimit.MaxSessions,
 	}
 
 	envVarsBool := map[string]*bool{
-		"DISPLAY_TRAFFIC":           &Config.FeatureIfaceTraffic,
-		"ENABLE_SPEEDTEST":          &Config.FeatureLibrespeed,
-		"UTILITIES_SPEEDTESTDOTNET": &Config.FeatureSpeedtestDotNet,
-		"UTILITIES_PING":            &Config.FeaturePing,
-		"UTILITIES_FAKESHELL":       &Config.FeatureShell,
-		"UTILITIES_IPERF3":          &Config.FeatureIperf3,
-		"UTILITIES_MTR":             &Config.FeatureMTR,
-		"UTILITIES_TRACEROUTE":      &Config.FeatureTraceroute,
+		"DISPLAY_TRAFFIC":           &cfg.FeatureIfaceTraffic,
+		"ENABLE_SPEEDTEST":          &cfg.FeatureLibrespeed,
+		"UTILITIES_SPEEDTESTDOTNET": &cfg.FeatureSpeedtestDotNet,
+		"UTILITIES_PING":            &cfg.FeaturePing,
+		"UTILITIES_FAKESHELL":       &cfg.FeatureShell,
+		"UTILITIES_IPERF3":          &cfg.FeatureIperf3,
+		"UTILITIES_MTR":             &cfg.FeatureMTR,
+		"UTILITIES_TRACEROUTE":      &cfg.FeatureTraceroute,
+		"FEDERATION":                &cfg.FeatureFederation,
 	}
 
 	for envVar, configField := range envVarsString {
@@ -41,28 +106,87 @@ func LoadFromEnv() {
 		}
 	}
 
-	for envVar, configField := range envVarsInt {
+	for _, envVar := range sortedKeys(envVarsInt) {
 		if v := os.Getenv(envVar); len(v) != 0 {
-			v, err := strconv.Atoi(v)
+			i, err := strconv.Atoi(v)
 			if err != nil {
+				problems = append(problems, fmt.Errorf("%s: invalid integer %q", envVar, v))
 				continue
 			}
-			*configField = v
+			*envVarsInt[envVar] = i
 		}
 	}
 
-	for envVar, configField := range envVarsBool {
+	for _, envVar := range sortedKeys(envVarsBool) {
 		if v := os.Getenv(envVar); len(v) != 0 {
-			*configField = v == "true"
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s: invalid boolean %q, expected true or false", envVar, v))
+				continue
+			}
+			*envVarsBool[envVar] = b
 		}
 	}
 
 	if v := os.Getenv("SPEEDTEST_FILE_LIST"); len(v) != 0 {
-		fileLists := strings.Split(v, " ")
-		Config.SpeedtestFileList = fileLists
+		fileLists := strings.Fields(v)
+		cfg.SpeedtestFileList = fileLists
+	}
+
+	if v := os.Getenv("RATE_LIMIT_EXEMPT"); len(v) != 0 {
+		cfg.RateLimit.Exempt = splitNetworks(v)
+	}
+
+	if v, ok := os.LookupEnv("RATE_LIMIT_TRUSTED_PROXIES"); ok {
+		cfg.RateLimit.TrustedProxies = splitNetworks(v)
+	}
+
+	if v := os.Getenv("TARGET_DENY"); len(v) != 0 {
+		cfg.TargetPolicy.Deny = splitNetworks(v)
+	}
+
+	if v := os.Getenv("TARGET_ALLOW"); len(v) != 0 {
+		cfg.TargetPolicy.Allow = splitNetworks(v)
+	}
+
+	if v := os.Getenv("LG_NODES"); len(v) != 0 {
+		cfg.Nodes = parseNodeList(v)
 	}
 
 	if !IsInternalCall {
 		log.Default().Println("Loading config from environment variables...")
 	}
+	return problems
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseNodeList parses the legacy LG_NODES format "name|location|url;..."
+func parseNodeList(v string) []NodeConfig {
+	var nodes []NodeConfig
+	for _, nodeStr := range strings.Split(v, ";") {
+		parts := strings.Split(nodeStr, "|")
+		if len(parts) >= 3 {
+			nodes = append(nodes, NodeConfig{
+				Name:     parts[0],
+				Location: parts[1],
+				URL:      parts[2],
+			})
+		}
+	}
+	return nodes
+}
+
+// splitNetworks splits a comma or space separated list of IPs and CIDRs
+func splitNetworks(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
 }
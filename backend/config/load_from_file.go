@@ -0,0 +1,97 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the path of the YAML or TOML config file, empty if none
+var ConfigFile string
+
+// LoadFromFile reads a YAML or TOML config file on top of cfg.
+// Keys that are absent from the file keep their current value.
+func LoadFromFile(cfg *ALSConfig, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Unknown keys are rejected so typos don't go unnoticed
+	var explicit explicitKeys
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		yaml.Unmarshal(data, &explicit)
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+		if err == io.EOF {
+			// empty file
+			err = nil
+		}
+	case ".toml":
+		toml.Unmarshal(data, &explicit)
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	default:
+		return fmt.Errorf("unsupported config file format %q, expected .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return err
+	}
+
+	if !IsInternalCall {
+		log.Default().Println("Loading config from file " + path + "...")
+	}
+	applyDeprecatedKeys(cfg, explicit)
+	return nil
+}
+
+// explicitKeys tells which of the keys replacing deprecated ones a file sets,
+// the defaults in cfg hide that
+type explicitKeys struct {
+	Ping struct {
+		Count *int `yaml:"count" toml:"count"`
+	} `yaml:"ping" toml:"ping"`
+	MTR struct {
+		Count *int `yaml:"count" toml:"count"`
+	} `yaml:"mtr" toml:"mtr"`
+}
+
+// applyDeprecatedKeys moves the values of renamed keys to their new place,
+// unless the file sets the new key as well
+func applyDeprecatedKeys(cfg *ALSConfig, explicit explicitKeys) {
+	aliases := []struct {
+		old, new string
+		value    **int
+		target   *int
+		set      bool
+	}{
+		{"ping_count", "ping.count", &cfg.DeprecatedPingCount, &cfg.Ping.Count, explicit.Ping.Count != nil},
+		{"mtr_report_cycles", "mtr.count", &cfg.DeprecatedMTRReportCycles, &cfg.MTR.Count, explicit.MTR.Count != nil},
+	}
+	for _, alias := range aliases {
+		if *alias.value == nil {
+			continue
+		}
+		if alias.set {
+			if !IsInternalCall {
+				log.Default().Printf("WARN: Config keys %s and %s are both set, %s is ignored", alias.old, alias.new, alias.old)
+			}
+		} else {
+			if !IsInternalCall {
+				log.Default().Printf("WARN: Config key %s is deprecated, use %s instead", alias.old, alias.new)
+			}
+			*alias.target = **alias.value
+		}
+		*alias.value = nil
+	}
+}
@@ -29,7 +29,8 @@ func updateLocation() {
 		return
 	}
 
-	Config.Location = fmt.Sprintf("%s, %s", data["city"], data["country_name"])
-	log.Default().Println("Server location: " + Config.Location)
+	location := fmt.Sprintf("%s, %s", data["city"], data["country_name"])
+	update(func(cfg *ALSConfig) { cfg.Location = location })
+	log.Default().Println("Server location: " + location)
 	log.Default().Println("Updating server location from internet successed, from ipapi.co")
 }
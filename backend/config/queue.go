@@ -0,0 +1,51 @@
+package config
+
+import "fmt"
+
+// QueueConfig limits how many runs of each resource pool may happen at the
+// same time, further requests wait in the queue of the pool. 0 is unlimited.
+// Runs are cancelled by the queue after MaxRunTime seconds, 0 disables it.
+type QueueConfig struct {
+	SpeedtestCLI int `json:"-" yaml:"speedtest_cli" toml:"speedtest_cli"`
+	FileDownload int `json:"-" yaml:"file_download" toml:"file_download"`
+	Iperf3       int `json:"-" yaml:"iperf3" toml:"iperf3"`
+	MTR          int `json:"-" yaml:"mtr" toml:"mtr"`
+	Traceroute   int `json:"-" yaml:"traceroute" toml:"traceroute"`
+	MaxRunTime   int `json:"-" yaml:"max_run_time" toml:"max_run_time"`
+}
+
+func defaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		SpeedtestCLI: 1,
+		FileDownload: 1,
+		Iperf3:       1,
+		MTR:          4,
+		Traceroute:   4,
+		MaxRunTime:   3600,
+	}
+}
+
+// Limits returns the concurrency limit of each pool by pool name
+func (q QueueConfig) Limits() map[string]int {
+	return map[string]int{
+		"speedtest_cli": q.SpeedtestCLI,
+		"file_download": q.FileDownload,
+		"iperf3":        q.Iperf3,
+		"mtr":           q.MTR,
+		"traceroute":    q.Traceroute,
+	}
+}
+
+func validateQueue(q QueueConfig) []error {
+	var problems []error
+	limits := q.Limits()
+	for _, pool := range sortedKeys(limits) {
+		if limit := limits[pool]; limit < 0 {
+			problems = append(problems, fmt.Errorf("queue.%s: must not be negative, got %d", pool, limit))
+		}
+	}
+	if q.MaxRunTime < 0 {
+		problems = append(problems, fmt.Errorf("queue.max_run_time: must not be negative, got %d", q.MaxRunTime))
+	}
+	return problems
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// RateLimitConfig limits what a single client IP may do. A limit of 0 is
+// unlimited.
+type RateLimitConfig struct {
+	RequestsPerMinute int            `json:"-" yaml:"requests_per_minute" toml:"requests_per_minute"` // per tool
+	Tools             map[string]int `json:"-" yaml:"tools" toml:"tools"`                             // requests per minute of single tools
+	MaxConcurrentJobs int            `json:"-" yaml:"max_concurrent_jobs" toml:"max_concurrent_jobs"`
+	MaxSessions       int            `json:"-" yaml:"max_sessions" toml:"max_sessions"`
+	Exempt            []string       `json:"-" yaml:"exempt" toml:"exempt"` // IPs or CIDRs that are never limited
+	// Proxies whose X-Forwarded-For and X-Real-IP headers are believed when
+	// telling the client IP, IPs or CIDRs. Read at startup only.
+	TrustedProxies []string `json:"-" yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+func defaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		RequestsPerMinute: 30,
+		// A LibreSpeed run sends many short requests
+		Tools:             map[string]int{"librespeed": 600},
+		MaxConcurrentJobs: 4,
+		MaxSessions:       10,
+		TrustedProxies:    []string{"127.0.0.1", "::1"},
+	}
+}
+
+// RequestLimit returns how many requests per minute a client may send to tool
+func (r RateLimitConfig) RequestLimit(tool string) int {
+	if limit, ok := r.Tools[tool]; ok {
+		return limit
+	}
+	return r.RequestsPerMinute
+}
+
+// IsExempt reports whether ip is never limited
+func (r RateLimitConfig) IsExempt(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range ParseNetworks(r.Exempt) {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRateLimit(r RateLimitConfig) []error {
+	var problems []error
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, a...))
+	}
+
+	if r.RequestsPerMinute < 0 {
+		add("rate_limit.requests_per_minute: must not be negative, got %d", r.RequestsPerMinute)
+	}
+	for _, tool := range sortedKeys(r.Tools) {
+		if r.Tools[tool] < 0 {
+			add("rate_limit.tools.%s: must not be negative, got %d", tool, r.Tools[tool])
+		}
+	}
+	if r.MaxConcurrentJobs < 0 {
+		add("rate_limit.max_concurrent_jobs: must not be negative, got %d", r.MaxConcurrentJobs)
+	}
+	if r.MaxSessions < 0 {
+		add("rate_limit.max_sessions: must not be negative, got %d", r.MaxSessions)
+	}
+	problems = append(problems, validateNetworks("rate_limit.exempt", r.Exempt)...)
+	problems = append(problems, validateNetworks("rate_limit.trusted_proxies", r.TrustedProxies)...)
+	return problems
+}
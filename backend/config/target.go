@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TargetPolicyConfig adds to the reserved networks that tools may not be run
+// against. Allowed networks override both.
+type TargetPolicyConfig struct {
+	Deny  []string `json:"-" yaml:"deny" toml:"deny"`   // IPs or CIDRs
+	Allow []string `json:"-" yaml:"allow" toml:"allow"` // IPs or CIDRs
+}
+
+// ParseNetwork parses an IP or CIDR entry of an operator list, a single IP is
+// a network of one address
+func ParseNetwork(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid CIDR", entry)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not a valid IP address", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// ParseNetworks parses entries, skipping the invalid ones which are reported
+// by Validate
+func ParseNetworks(entries []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if network, err := ParseNetwork(entry); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func validateNetworks(field string, entries []string) []error {
+	var problems []error
+	for _, entry := range entries {
+		if _, err := ParseNetwork(entry); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", field, err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// replySlack is the time a run needs after its last packet for the reply
+const replySlack = 5 * time.Second
+
+// ToolConfig holds the operator defaults of a measurement tool and the bounds
+// within which a request may override them. A zero default lets the tool use
+// its own, a zero bound disables the per-request override.
+type ToolConfig struct {
+	Count         int `json:"count" yaml:"count" toml:"count"` // ping packets or mtr report cycles
+	MaxCount      int `json:"max_count" yaml:"max_count" toml:"max_count"`
+	Interval      int `json:"interval" yaml:"interval" toml:"interval"` // in milliseconds
+	MinInterval   int `json:"min_interval" yaml:"min_interval" toml:"min_interval"`
+	MaxInterval   int `json:"max_interval" yaml:"max_interval" toml:"max_interval"`
+	PacketSize    int `json:"packet_size" yaml:"packet_size" toml:"packet_size"` // in bytes
+	MaxPacketSize int `json:"max_packet_size" yaml:"max_packet_size" toml:"max_packet_size"`
+	MaxHops       int `json:"max_hops" yaml:"max_hops" toml:"max_hops"`
+	MaxHopsLimit  int `json:"max_hops_limit" yaml:"max_hops_limit" toml:"max_hops_limit"`
+	Timeout       int `json:"-" yaml:"timeout" toml:"timeout"` // in seconds, 0 uses tool_timeout
+}
+
+// TimeoutSeconds returns the timeout of the tool, toolTimeout unless the
+// tool sets its own
+func (t ToolConfig) TimeoutSeconds(toolTimeout int) int {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return toolTimeout
+}
+
+// RunDuration is how long a run of count packets or cycles takes at interval
+// (in milliseconds, 0 for the default of one second)
+func RunDuration(count int, interval int) time.Duration {
+	if interval <= 0 {
+		interval = 1000
+	}
+	return time.Duration(count)*time.Duration(interval)*time.Millisecond + replySlack
+}
+
+func defaultPingConfig() ToolConfig {
+	return ToolConfig{
+		Count:         10,
+		MaxCount:      100,
+		Interval:      1000,
+		MinInterval:   200,
+		MaxInterval:   5000,
+		PacketSize:    56,
+		MaxPacketSize: 1472,
+	}
+}
+
+func defaultMTRConfig() ToolConfig {
+	return ToolConfig{
+		Count:        10,
+		MaxCount:     100,
+		Interval:     1000,
+		MinInterval:  1000,
+		MaxInterval:  5000,
+		MaxHops:      30,
+		MaxHopsLimit: 64,
+	}
+}
+
+func defaultTracerouteConfig() ToolConfig {
+	return ToolConfig{
+		MaxHops:      30,
+		MaxHopsLimit: 64,
+	}
+}
+
+// validateTool checks that the defaults of a tool are sane and within its bounds
+func validateTool(name string, t ToolConfig) []error {
+	var problems []error
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(name+"."+format, a...))
+	}
+
+	fields := []struct {
+		name  string
+		value int
+	}{
+		{"count", t.Count}, {"max_count", t.MaxCount},
+		{"interval", t.Interval}, {"min_interval", t.MinInterval}, {"max_interval", t.MaxInterval},
+		{"packet_size", t.PacketSize}, {"max_packet_size", t.MaxPacketSize},
+		{"max_hops", t.MaxHops}, {"max_hops_limit", t.MaxHopsLimit},
+		{"timeout", t.Timeout},
+	}
+	for _, field := range fields {
+		if field.value < 0 {
+			add("%s: must not be negative, got %d", field.name, field.value)
+		}
+	}
+
+	if t.MaxCount > 0 && t.Count > t.MaxCount {
+		add("count: %d exceeds max_count %d", t.Count, t.MaxCount)
+	}
+	if t.MinInterval > 0 && t.Interval > 0 && t.Interval < t.MinInterval {
+		add("interval: %d is below min_interval %d", t.Interval, t.MinInterval)
+	}
+	if t.MaxInterval > 0 {
+		if t.MinInterval == 0 {
+			add("max_interval: requires min_interval")
+		} else if t.MaxInterval < t.MinInterval {
+			add("max_interval: %d is below min_interval %d", t.MaxInterval, t.MinInterval)
+		}
+		if t.Interval > t.MaxInterval {
+			add("interval: %d exceeds max_interval %d", t.Interval, t.MaxInterval)
+		}
+	}
+	if t.MaxPacketSize > 0 && t.PacketSize > t.MaxPacketSize {
+		add("packet_size: %d exceeds max_packet_size %d", t.PacketSize, t.MaxPacketSize)
+	}
+	if t.MaxHopsLimit > 0 && t.MaxHops > t.MaxHopsLimit {
+		add("max_hops: %d exceeds max_hops_limit %d", t.MaxHops, t.MaxHopsLimit)
+	}
+	if t.MaxHopsLimit > 255 {
+		add("max_hops_limit: %d exceeds 255", t.MaxHopsLimit)
+	}
+
+	return problems
+}
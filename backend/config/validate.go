@@ -0,0 +1,193 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var logoTypes = []string{"auto", "url", "base64", "svg", "emoji", "text"}
+
+var nodeStorages = []string{"file", "sqlite"}
+
+var sizeRegex = regexp.MustCompile(`^(\d+)(KB|MB|GB|TB)$`)
+
+// SizeToBytes converts a speedtest file size such as "100MB" to bytes
+func SizeToBytes(size string) (int64, error) {
+	matches := sizeRegex.FindStringSubmatch(size)
+
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size format")
+	}
+
+	num, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	switch strings.ToUpper(matches[2]) {
+	case "KB":
+		num *= 1024
+	case "MB":
+		num *= 1024 * 1024
+	case "GB":
+		num *= 1024 * 1024 * 1024
+	case "TB":
+		num *= 1024 * 1024 * 1024 * 1024
+	}
+
+	return num, nil
+}
+
+// Validate checks cfg for invalid values and returns every problem found
+func Validate(cfg *ALSConfig) []error {
+	var problems []error
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, a...))
+	}
+
+	if !isValidPort(cfg.ListenPort) {
+		add("listen_port: %q is not a valid port", cfg.ListenPort)
+	}
+
+	if cfg.Iperf3StartPort < 1 || cfg.Iperf3StartPort > 65535 {
+		add("iperf3_port_min: %d is out of range 1-65535", cfg.Iperf3StartPort)
+	}
+	if cfg.Iperf3EndPort < 1 || cfg.Iperf3EndPort > 65535 {
+		add("iperf3_port_max: %d is out of range 1-65535", cfg.Iperf3EndPort)
+	}
+	if cfg.Iperf3StartPort > cfg.Iperf3EndPort {
+		add("iperf3 port range is inverted: %d > %d", cfg.Iperf3StartPort, cfg.Iperf3EndPort)
+	}
+
+	for _, size := range cfg.SpeedtestFileList {
+		if _, err := SizeToBytes(size); err != nil {
+			add("speedtest_files: %q has an unknown size, expected a number followed by KB, MB, GB or TB", size)
+		}
+	}
+
+	if !contains(logoTypes, cfg.LogoType) {
+		add("logo_type: unknown type %q, expected one of %s", cfg.LogoType, strings.Join(logoTypes, ", "))
+	}
+
+	if cfg.PublicIPv4 != "" {
+		if ip := net.ParseIP(cfg.PublicIPv4); ip == nil || ip.To4() == nil {
+			add("public_ipv4: %q is not an IPv4 address", cfg.PublicIPv4)
+		}
+	}
+	if cfg.PublicIPv6 != "" {
+		if ip := net.ParseIP(cfg.PublicIPv6); ip == nil || ip.To4() != nil {
+			add("public_ipv6: %q is not an IPv6 address", cfg.PublicIPv6)
+		}
+	}
+
+	if cfg.ToolTimeout < 1 {
+		add("tool_timeout: must be positive, got %d", cfg.ToolTimeout)
+	}
+	if cfg.Ping.Count < 1 {
+		add("ping.count: must be positive, got %d", cfg.Ping.Count)
+	}
+	if cfg.MTR.Count < 1 {
+		add("mtr.count: must be positive, got %d", cfg.MTR.Count)
+	}
+	for _, tool := range []struct {
+		name string
+		t    ToolConfig
+	}{{"ping", cfg.Ping}, {"mtr", cfg.MTR}} {
+		timeout := tool.t.TimeoutSeconds(cfg.ToolTimeout)
+		if RunDuration(tool.t.Count, tool.t.Interval) > time.Duration(timeout)*time.Second {
+			add("%s: count %d at interval %d ms does not finish within the %d second timeout", tool.name, tool.t.Count, tool.t.Interval, timeout)
+		}
+	}
+	problems = append(problems, validateTool("ping", cfg.Ping)...)
+	problems = append(problems, validateTool("mtr", cfg.MTR)...)
+	problems = append(problems, validateTool("traceroute", cfg.Traceroute)...)
+	problems = append(problems, validateTool("speedtest", cfg.Speedtest)...)
+	problems = append(problems, validateQueue(cfg.Queue)...)
+	problems = append(problems, validateRateLimit(cfg.RateLimit)...)
+	problems = append(problems, validateNetworks("target_policy.deny", cfg.TargetPolicy.Deny)...)
+	problems = append(problems, validateNetworks("target_policy.allow", cfg.TargetPolicy.Allow)...)
+
+	if !contains(nodeStorages, cfg.NodeStorage) {
+		add("node_storage: unknown storage %q, expected one of %s", cfg.NodeStorage, strings.Join(nodeStorages, ", "))
+	}
+
+	if cfg.NodeHealthInterval < 0 {
+		add("node_health_interval: must not be negative, got %d", cfg.NodeHealthInterval)
+	}
+	if cfg.NodeHealthTimeout < 1 {
+		add("node_health_timeout: must be positive, got %d", cfg.NodeHealthTimeout)
+	}
+	if cfg.NodeStaleAfter < 1 {
+		add("node_stale_after: must be positive, got %d", cfg.NodeStaleAfter)
+	}
+	if cfg.NodeExpireAfter < 0 {
+		add("node_expire_after: must not be negative, got %d", cfg.NodeExpireAfter)
+	}
+
+	if cfg.CurrentNodeURL != "" && !isValidHttpURL(cfg.CurrentNodeURL) {
+		add("current_node_url: %q is not an http(s) URL", cfg.CurrentNodeURL)
+	}
+
+	if cfg.AgentControllerURL != "" {
+		if !isValidHttpURL(cfg.AgentControllerURL) {
+			add("agent_controller_url: %q is not an http(s) URL", cfg.AgentControllerURL)
+		}
+		if cfg.AgentToken == "" {
+			add("agent_token: required when agent_controller_url is set")
+		}
+	}
+
+	if cfg.ControllerURL != "" {
+		if !isValidHttpURL(cfg.ControllerURL) {
+			add("controller_url: %q is not an http(s) URL", cfg.ControllerURL)
+		}
+		if cfg.EnrollmentToken == "" {
+			add("enrollment_token: required when controller_url is set")
+		}
+		if cfg.CurrentNodeName == "" || cfg.CurrentNodeURL == "" {
+			add("current_node_name and current_node_url: required when controller_url is set")
+		}
+		if cfg.HeartbeatInterval < 1 {
+			add("heartbeat_interval: must be positive, got %d", cfg.HeartbeatInterval)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, node := range cfg.Nodes {
+		if node.Name == "" {
+			add("nodes[%d]: name is required", i)
+		} else if names[node.Name] {
+			add("nodes[%d]: duplicate name %q", i, node.Name)
+		}
+		names[node.Name] = true
+		if !isValidHttpURL(node.URL) {
+			add("nodes[%d]: url %q is not an http(s) URL", i, node.URL)
+		}
+	}
+
+	return problems
+}
+
+func isValidPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p >= 1 && p <= 65535
+}
+
+func isValidHttpURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func contains(slice []string, item string) bool {
+	for _, a := range slice {
+		if a == item {
+			return true
+		}
+	}
+	return false
+}
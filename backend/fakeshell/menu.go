@@ -1,12 +1,14 @@
 package fakeshell
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os/exec"
 	"regexp"
 
 	"github.com/reeflective/console"
+	"github.com/X-Zero-L/als/als/target"
 	"github.com/X-Zero-L/als/config"
 	"github.com/X-Zero-L/als/fakeshell/commands"
 	"github.com/spf13/cobra"
@@ -22,11 +24,11 @@ func defineMenuCommands(a *console.Console) console.Commands {
 		rootCmd.DisableFlagsInUseLine = true
 
 		features := map[string]bool{
-			"ping":       config.Config.FeaturePing,
-			"traceroute": config.Config.FeatureTraceroute,
-			"nexttrace":  config.Config.FeatureTraceroute,
-			"speedtest":  config.Config.FeatureSpeedtestDotNet,
-			"mtr":        config.Config.FeatureMTR,
+			"ping":       config.Get().FeaturePing,
+			"traceroute": config.Get().FeatureTraceroute,
+			"nexttrace":  config.Get().FeatureTraceroute,
+			"speedtest":  config.Get().FeatureSpeedtestDotNet,
+			"mtr":        config.Get().FeatureMTR,
 		}
 
 		argsFilter := map[string]func([]string) ([]string, error){
@@ -37,8 +39,11 @@ func defineMenuCommands(a *console.Console) console.Commands {
 						return []string{}, errors.New("dangerous flag detected, stop running")
 					}
 				}
-				return args, nil
+				return checkTargets(args)
 			},
+			"traceroute": checkTargets,
+			"nexttrace":  checkTargets,
+			"mtr":        checkTargets,
 		}
 
 		hasNotFound := false
@@ -77,3 +82,13 @@ func defineMenuCommands(a *console.Console) console.Commands {
 		return rootCmd
 	}
 }
+
+// checkTargets refuses to run a command against targets the target policy
+// does not allow, host names are passed on as the address that was checked
+func checkTargets(args []string) ([]string, error) {
+	checked, err := target.CheckArgs(context.Background(), args)
+	if err != nil {
+		return []string{}, err
+	}
+	return checked, nil
+}
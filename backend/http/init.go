@@ -1,6 +1,9 @@
 package http
 
 import (
+	"log"
+
+	"github.com/X-Zero-L/als/config"
 	"github.com/gin-gonic/gin"
 )
 
@@ -13,9 +16,12 @@ func CreateServer() *Server {
 	gin.SetMode(gin.ReleaseMode)
 	engine := gin.Default()
 	
-	// Configure trusted proxies to handle frp and other reverse proxies
-	// This allows ClientIP() to properly parse X-Forwarded-For and X-Real-IP headers
-	engine.SetTrustedProxies([]string{"127.0.0.1", "::1", "0.0.0.0/0"})
+	// Only the configured reverse proxies may tell the client IP through
+	// X-Forwarded-For and X-Real-IP, anyone else could pick the IP that rate
+	// limits are keyed on
+	if err := engine.SetTrustedProxies(config.Get().RateLimit.TrustedProxies); err != nil {
+		log.Fatalf("Invalid rate_limit.trusted_proxies: %v", err)
+	}
 	
 	e := &Server{
 		engine: engine,
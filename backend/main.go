@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/X-Zero-L/als/als"
 	"github.com/X-Zero-L/als/config"
@@ -9,9 +11,24 @@ import (
 )
 
 var shell = flag.Bool("shell", false, "Start as fake shell")
+var checkConfig = flag.Bool("check-config", false, "Validate the config and exit")
+var configFile = flag.String("config", os.Getenv("CONFIG_FILE"), "Path to a YAML or TOML config file")
 
 func main() {
 	flag.Parse()
+	config.ConfigFile = *configFile
+	if *checkConfig {
+		problems := config.Check()
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "ERROR: "+problem.Error())
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Config OK")
+		return
+	}
+
 	if *shell {
 		config.IsInternalCall = true
 		config.Load()